@@ -0,0 +1,231 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+type AccountStatus string
+
+const (
+	AccountStatusActive AccountStatus = "active"
+	AccountStatusFrozen AccountStatus = "frozen"
+	AccountStatusClosed AccountStatus = "closed"
+)
+
+type AccountResult struct {
+	Status  Status  `json:"status"`
+	Balance Balance `json:"balance"`
+}
+
+type CloseAccountResult struct {
+	Status       Status  `json:"status"`
+	Balance      Balance `json:"balance"`
+	SweptBalance Balance `json:"swept_balance"`
+	SweptPoint   float32 `json:"swept_point"`
+}
+
+// 口座の状態を取得する
+// 状態を持たない既存データは有効な口座として扱う
+func (s *SmartContract) getAccountStatus(balance Balance) AccountStatus {
+	if balance.AccountStatus == "" {
+		return AccountStatusActive
+	}
+	return balance.AccountStatus
+}
+
+// 口座から出金できるかチェックする
+func (s *SmartContract) checkOutgoing(balance Balance) (Status, string) {
+	switch s.getAccountStatus(balance) {
+	case AccountStatusFrozen:
+		return StatusNotAllowed, "譲渡元の口座は凍結されています"
+	case AccountStatusClosed:
+		return StatusNotAllowed, "譲渡元の口座は解約されています"
+	}
+	return StatusOk, ""
+}
+
+// 口座へ入金できるかチェックする
+// 残高データがない場合は譲渡時に作成されるので入金可能とする
+func (s *SmartContract) checkIncoming(balance Balance) (Status, string) {
+	switch s.getAccountStatus(balance) {
+	case AccountStatusFrozen:
+		if balance.BlockIncoming {
+			return StatusNotAllowed, "譲渡先の口座は凍結されています"
+		}
+	case AccountStatusClosed:
+		return StatusNotAllowed, "譲渡先の口座は解約されています"
+	}
+	return StatusOk, ""
+}
+
+// 口座を凍結する(管理者のみ)
+// 入金も止める場合は2つ目の引数に"true"を指定する
+func (s *SmartContract) freezeAccount(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+
+	userId := args[0]
+	blockIncoming := false
+	if len(args) == 2 {
+		val, err := strconv.ParseBool(args[1])
+		if err != nil {
+			return shim.Error("Incorrect type of arguments.")
+		}
+		blockIncoming = val
+	}
+
+	if !s.isAdminInvoker(APIstub) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "管理者のみ実行できます")
+	}
+	if userId == AdminUserId {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "管理者の口座は凍結できません")
+	}
+
+	balance := s.getUserBalance(APIstub, userId)
+	if !s.isValidBalance(balance) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "残高が見つかりませんでした")
+	}
+	if s.getAccountStatus(balance) == AccountStatusClosed {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "解約済みの口座です")
+	}
+
+	balance.AccountStatus = AccountStatusFrozen
+	balance.BlockIncoming = blockIncoming
+	s.putBalance(APIstub, balance)
+
+	result := AccountResult{Status: StatusOk, Balance: balance}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 口座の凍結を解除する(管理者のみ)
+func (s *SmartContract) unfreezeAccount(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	if !s.isAdminInvoker(APIstub) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "管理者のみ実行できます")
+	}
+
+	balance := s.getUserBalance(APIstub, args[0])
+	if !s.isValidBalance(balance) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "残高が見つかりませんでした")
+	}
+	if s.getAccountStatus(balance) != AccountStatusFrozen {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "凍結されていない口座です")
+	}
+
+	balance.AccountStatus = AccountStatusActive
+	balance.BlockIncoming = false
+	s.putBalance(APIstub, balance)
+
+	result := AccountResult{Status: StatusOk, Balance: balance}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 口座を解約する(管理者のみ)
+// 仮押さえはすべて解放し、残高は指定の口座へ移動する
+// デフォルト以外のポイント種別の残高が残っている場合は、先にtransferTokenで移動しておくこと
+func (s *SmartContract) closeAccount(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	userId := args[0]
+	sweepToUserId := args[1]
+
+	if !s.isAdminInvoker(APIstub) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "管理者のみ実行できます")
+	}
+	if userId == AdminUserId {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "管理者の口座は解約できません")
+	}
+	if userId == sweepToUserId {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "解約する口座と移動先が同じです")
+	}
+
+	balance := s.getUserBalance(APIstub, userId)
+	if !s.isValidBalance(balance) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "残高が見つかりませんでした")
+	}
+	if s.getAccountStatus(balance) == AccountStatusClosed {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "解約済みの口座です")
+	}
+	if s.isHotAccount(APIstub, DefaultTokenType, userId) {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "高頻度口座の設定を解除してから解約してください")
+	}
+	if status, message := s.checkIncoming(s.getUserBalance(APIstub, sweepToUserId)); status != StatusOk {
+		return s.makeErrorResponce(APIstub, status, message)
+	}
+
+	// デフォルト以外のポイント種別の残高は移動しないので、残っている場合は解約できない
+	tokenTypes, err := s.getTokenTypes(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, tokenType := range tokenTypes {
+		if s.isDefaultTokenType(tokenType.TokenType) {
+			continue
+		}
+		tokenBalance := s.getUserTokenBalance(APIstub, tokenType.TokenType, userId)
+		if tokenBalance.Amount != 0 || tokenBalance.Held != 0 {
+			return s.makeErrorResponce(APIstub, StatusBadRequest, fmt.Sprintf("ポイント種別(%s)の残高が残っているため解約できません", tokenType.TokenType))
+		}
+	}
+
+	// 仮押さえをすべて解放
+	for _, hold := range s.getActiveHolds(APIstub, userId) {
+		balance = s.restoreHeldAmount(balance, hold)
+		hold.HoldStatus = HoldStatusReleased
+		s.putHold(APIstub, hold)
+	}
+
+	balance.AccountStatus = AccountStatusClosed
+	balance.BlockIncoming = true
+	balance.ClosedTo = sweepToUserId
+
+	total := balance.Amount
+	sweptBalance := s.getUserBalance(APIstub, sweepToUserId)
+	if total > 0 {
+		balance, sweptBalance = s.applyTransfer(APIstub, balance, sweepToUserId, total, "")
+	} else {
+		s.putBalance(APIstub, balance)
+	}
+
+	result := CloseAccountResult{Status: StatusOk, Balance: balance, SweptBalance: sweptBalance, SweptPoint: total}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
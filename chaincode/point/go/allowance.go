@@ -0,0 +1,237 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+type Allowance struct {
+	OwnerId   string  `json:"owner_id"`   // "1725"
+	SpenderId string  `json:"spender_id"` // "shop"
+	Limit     float32 `json:"limit"`      // 1000.000
+	Spent     float32 `json:"spent"`      // 300.000
+	ExpiresAt string  `json:"expires_at"` // "2018-08-01 00:00:00 UTC"
+}
+
+type AllowanceResult struct {
+	Status    Status    `json:"status"`
+	Allowance Allowance `json:"allowance"`
+	Remaining float32   `json:"remaining"`
+}
+
+type TransferFromResult struct {
+	Status           Status    `json:"status"`
+	FromUserBalance  Balance   `json:"from_user_balance"`
+	ToUserBalance    Balance   `json:"to_user_balance"`
+	Allowance        Allowance `json:"allowance"`
+	RemainingAllowed float32   `json:"remaining_allowed"`
+}
+
+const allowanceIndexName = "allowance"
+
+// Allowance用Stateキー作成関数
+// 委任元と委任先の組み合わせが一意になるよう複合キーとする
+func (s *SmartContract) makeAllowanceKey(APIstub shim.ChaincodeStubInterface, ownerId string, spenderId string) string {
+	key, _ := APIstub.CreateCompositeKey(allowanceIndexName, []string{ownerId, spenderId})
+	return key
+}
+
+// 指定の委任データ取得
+func (s *SmartContract) getAllowanceFromState(APIstub shim.ChaincodeStubInterface, ownerId string, spenderId string) Allowance {
+	allowanceAsBytes, _ := APIstub.GetState(s.makeAllowanceKey(APIstub, ownerId, spenderId))
+	allowance := Allowance{}
+
+	if len(allowanceAsBytes) != 0 {
+		json.Unmarshal(allowanceAsBytes, &allowance)
+	}
+
+	return allowance
+}
+
+// 委任データput
+func (s *SmartContract) putAllowance(APIstub shim.ChaincodeStubInterface, allowance Allowance) {
+	allowanceAsBytes, _ := json.Marshal(allowance)
+	APIstub.PutState(s.makeAllowanceKey(APIstub, allowance.OwnerId, allowance.SpenderId), allowanceAsBytes)
+}
+
+// 委任データが有効であるか判別する
+func (s *SmartContract) isValidAllowance(APIstub shim.ChaincodeStubInterface, allowance Allowance) bool {
+	if allowance.OwnerId == "" {
+		return false
+	}
+
+	expiresAt, err := time.Parse(DateTimeFormat, allowance.ExpiresAt)
+	if err != nil {
+		return false
+	}
+
+	return s.getTxTime(APIstub).Before(expiresAt)
+}
+
+// 委任データの残り利用可能額
+func (s *SmartContract) getRemainingAllowance(allowance Allowance) float32 {
+	return allowance.Limit - allowance.Spent
+}
+
+// 呼び出し元ユーザーの残高から引き出せる上限と期限を委任先に設定する
+func (s *SmartContract) approve(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	ownerId := s.getInvokerId(APIstub)
+	spenderId := args[0]
+	val, err := strconv.ParseFloat(args[1], 32)
+	if err != nil || val < 0 {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	expiresAt, err := time.Parse(DateTimeFormat, args[2])
+	if err != nil {
+		return shim.Error("Incorrect type of arguments.")
+	}
+
+	if ownerId == "" {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "呼び出し元のユーザーを特定できませんでした")
+	}
+	if ownerId == spenderId {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "自分自身には委任できません")
+	}
+	if !expiresAt.After(s.getTxTime(APIstub)) {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "有効期限が過去の日時です")
+	}
+
+	// 再設定時は利用済み額をリセットする
+	allowance := Allowance{
+		OwnerId:   ownerId,
+		SpenderId: spenderId,
+		Limit:     float32(val),
+		Spent:     0.0,
+		ExpiresAt: expiresAt.UTC().Format(DateTimeFormat),
+	}
+	s.putAllowance(APIstub, allowance)
+
+	result := AllowanceResult{Status: StatusOk, Allowance: allowance, Remaining: s.getRemainingAllowance(allowance)}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 委任された範囲で他ユーザーの残高から譲渡する
+func (s *SmartContract) transferFrom(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	spenderId := s.getInvokerId(APIstub)
+	ownerId := args[0]
+	toUserId := args[1]
+	point, err := strconv.ParseFloat(args[2], 32)
+	if err != nil || point <= 0 {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	total := float32(point)
+
+	if spenderId == "" {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "呼び出し元のユーザーを特定できませんでした")
+	}
+	if ownerId == toUserId {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "譲渡元と譲渡先が同じです")
+	}
+
+	// 委任の有効チェック
+	allowance := s.getAllowanceFromState(APIstub, ownerId, spenderId)
+	if !s.isValidAllowance(APIstub, allowance) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "有効な委任がありません")
+	}
+	if total > s.getRemainingAllowance(allowance) {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "委任された上限を超えています")
+	}
+
+	// 譲渡元の有効チェック・残高チェック・譲渡上限チェックなどは通常の譲渡と同じ
+	fromBalance, toBalance, status, message := s.tryTransfer(APIstub, DefaultTokenType, ownerId, toUserId, total)
+	if status != StatusOk {
+		return s.makeErrorResponce(APIstub, status, message)
+	}
+
+	allowance.Spent += total
+	s.putAllowance(APIstub, allowance)
+
+	result := TransferFromResult{
+		Status:           StatusOk,
+		FromUserBalance:  fromBalance,
+		ToUserBalance:    toBalance,
+		Allowance:        allowance,
+		RemainingAllowed: s.getRemainingAllowance(allowance),
+	}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 呼び出し元ユーザーが設定した委任を取り消す
+func (s *SmartContract) revokeApproval(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	ownerId := s.getInvokerId(APIstub)
+	spenderId := args[0]
+
+	allowance := s.getAllowanceFromState(APIstub, ownerId, spenderId)
+	if allowance.OwnerId == "" {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "委任が見つかりませんでした")
+	}
+
+	APIstub.DelState(s.makeAllowanceKey(APIstub, ownerId, spenderId))
+
+	result := AllowanceResult{Status: StatusOk, Allowance: allowance, Remaining: 0.0}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+func (s *SmartContract) getAllowance(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	allowance := s.getAllowanceFromState(APIstub, args[0], args[1])
+
+	result := AllowanceResult{Status: StatusOk, Allowance: allowance, Remaining: s.getRemainingAllowance(allowance)}
+	if allowance.OwnerId == "" {
+		result.Status = StatusNotFound
+	} else if !s.isValidAllowance(APIstub, allowance) {
+		// 期限切れの場合は残り利用可能額を0として返す
+		result.Remaining = 0.0
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+	return shim.Success(resultAsBytes)
+}
@@ -0,0 +1,364 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 発行額と流通額の比較で許容する誤差(float32の丸め誤差分)
+const AuditTolerance = 0.01
+
+type IssuanceKind string
+
+const (
+	IssuanceKindIssue   IssuanceKind = "issue"
+	IssuanceKindBurn    IssuanceKind = "burn"
+	IssuanceKindGenesis IssuanceKind = "genesis"
+)
+
+// 発行記録の導入前から流通している残高を記録する発行者ID
+const GenesisIssuerId = "genesis"
+
+type IssuanceRecord struct {
+	TxId      string       `json:"tx_id"`      // "e3b0c442..."
+	TokenType string       `json:"token_type"` // "point"
+	IssuerId  string       `json:"issuer_id"`  // "admin"
+	Kind      IssuanceKind `json:"kind"`       // "issue"
+	Point     float32      `json:"price"`      // 1000.000 (焼却の場合は負の値)
+	CreatedAt string       `json:"created_at"` // "2018-07-01 20:32:11 UTC"
+}
+
+type AuditTokenSummary struct {
+	TokenType   string  `json:"token_type"`   // "point"
+	Issued      float64 `json:"issued"`       // 10000.000
+	Circulating float64 `json:"circulating"`  // 10000.000
+	Difference  float64 `json:"difference"`   // 0.000
+	AccountNum  int     `json:"account_num"`  // 25
+	IssuanceNum int     `json:"issuance_num"` // 3
+}
+
+type AuditDiscrepancy struct {
+	Key     string `json:"key"`     // "balance_1725"
+	Message string `json:"message"` // "残高が負の値です"
+}
+
+type AuditReport struct {
+	AuditedAt     string              `json:"audited_at"`     // "2018-07-01 20:32:11 UTC"
+	AuditorId     string              `json:"auditor_id"`     // "auditor1"
+	AuditorMspId  string              `json:"auditor_msp_id"` // "Org1MSP"
+	AuditorCert   string              `json:"auditor_cert"`   // "-----BEGIN CERTIFICATE-----\n..."(PEM)
+	TxId          string              `json:"tx_id"`          // "e3b0c442..."
+	Passed        bool                `json:"passed"`
+	Summaries     []AuditTokenSummary `json:"summaries"`
+	Discrepancies []AuditDiscrepancy  `json:"discrepancies"`
+}
+
+type AuditLedgerResult struct {
+	Status Status      `json:"status"`
+	Report AuditReport `json:"report"`
+	Digest string      `json:"digest"` // レポートのSHA-256
+}
+
+type AuditRecord struct {
+	Report AuditReport `json:"report"`
+	Digest string      `json:"digest"` // レポートのSHA-256
+}
+
+// IssuanceRecord用Stateキー作成関数
+func (s *SmartContract) makeIssuanceKey(txId string) string {
+	return "issuance_" + txId
+}
+
+// 発行記録の導入済みを示すStateキー作成関数
+// (発行記録の範囲検索に含まれないよう別の接頭辞とする)
+func (s *SmartContract) makeGenesisMarkerKey() string {
+	return "genesis_issuance_marker"
+}
+
+// AuditRecord用Stateキー作成関数
+func (s *SmartContract) makeAuditRecordKey(txId string) string {
+	return "audit_report_" + txId
+}
+
+// 発行記録put
+// トランザクション毎に別キーとするので同一ブロック内の発行同士で競合しない
+func (s *SmartContract) putIssuanceRecord(APIstub shim.ChaincodeStubInterface, tokenType string, issuerId string, point float32) {
+	kind := IssuanceKindIssue
+	if point < 0 {
+		kind = IssuanceKindBurn
+	}
+	if s.isDefaultTokenType(tokenType) {
+		tokenType = DefaultTokenType
+	}
+
+	record := IssuanceRecord{
+		TxId:      APIstub.GetTxID(),
+		TokenType: tokenType,
+		IssuerId:  issuerId,
+		Kind:      kind,
+		Point:     point,
+		CreatedAt: s.getTxTime(APIstub).Format(DateTimeFormat),
+	}
+	recordAsBytes, _ := json.Marshal(record)
+	APIstub.PutState(s.makeIssuanceKey(record.TxId), recordAsBytes)
+}
+
+// ポイント種別毎の集計を取得(なければ作成)
+func (s *SmartContract) getAuditSummary(summaries map[string]*AuditTokenSummary, tokenType string) *AuditTokenSummary {
+	if s.isDefaultTokenType(tokenType) {
+		tokenType = DefaultTokenType
+	}
+	if _, ok := summaries[tokenType]; !ok {
+		summaries[tokenType] = &AuditTokenSummary{TokenType: tokenType}
+	}
+	return summaries[tokenType]
+}
+
+// 発行記録と残高を集計する
+// 形式が不正なデータは集計から除き、discrepanciesに含めて返す
+func (s *SmartContract) collectAuditSummaries(APIstub shim.ChaincodeStubInterface) (map[string]*AuditTokenSummary, []AuditDiscrepancy, error) {
+	summaries := map[string]*AuditTokenSummary{}
+	discrepancies := []AuditDiscrepancy{}
+
+	// 発行記録の集計
+	issuanceIterator, err := APIstub.GetStateByRange(s.makeIssuanceKey(""), s.makeIssuanceKey(string(utf8.MaxRune)))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer issuanceIterator.Close()
+
+	for issuanceIterator.HasNext() {
+		queryResponse, err := issuanceIterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		record := IssuanceRecord{}
+		if err := json.Unmarshal(queryResponse.Value, &record); err != nil || record.TxId == "" {
+			discrepancies = append(discrepancies, AuditDiscrepancy{Key: queryResponse.Key, Message: "発行記録の形式が不正です"})
+			continue
+		}
+		summary := s.getAuditSummary(summaries, record.TokenType)
+		summary.Issued += float64(record.Point)
+		summary.IssuanceNum++
+	}
+
+	// 残高の集計
+	err = s.scanBalances(APIstub, func(key string, value []byte) {
+		balance := Balance{}
+		if err := json.Unmarshal(value, &balance); err != nil || !s.isValidBalance(balance) {
+			discrepancies = append(discrepancies, AuditDiscrepancy{Key: key, Message: "残高データの形式が不正です"})
+			return
+		}
+		if !s.isBalanceKeyOf(APIstub, key, balance) {
+			discrepancies = append(discrepancies, AuditDiscrepancy{Key: key, Message: "キーと残高データのユーザーIDまたはポイント種別が一致しません"})
+		}
+		if balance.Amount < 0 || balance.Held < 0 {
+			discrepancies = append(discrepancies, AuditDiscrepancy{Key: key, Message: "残高が負の値です"})
+		}
+		if math.IsNaN(float64(balance.Amount)) || math.IsNaN(float64(balance.Held)) {
+			discrepancies = append(discrepancies, AuditDiscrepancy{Key: key, Message: "残高が数値ではありません"})
+			return
+		}
+
+		summary := s.getAuditSummary(summaries, balance.TokenType)
+		summary.Circulating += float64(balance.Amount) + float64(balance.Held)
+		summary.AccountNum++
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 高頻度口座の未集約の差分の集計
+	deltaIterator, err := APIstub.GetStateByPartialCompositeKey(balanceDeltaIndexName, []string{})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer deltaIterator.Close()
+
+	for deltaIterator.HasNext() {
+		queryResponse, err := deltaIterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		delta := BalanceDelta{}
+		if err := json.Unmarshal(queryResponse.Value, &delta); err != nil || delta.UserId == "" {
+			discrepancies = append(discrepancies, AuditDiscrepancy{Key: queryResponse.Key, Message: "残高の差分データの形式が不正です"})
+			continue
+		}
+		summary := s.getAuditSummary(summaries, DefaultTokenType)
+		summary.Circulating += float64(delta.Amount) + float64(delta.Held)
+	}
+
+	// 高頻度口座の分割残高の集計
+	slotIterator, err := APIstub.GetStateByPartialCompositeKey(hotBalanceSlotIndexName, []string{})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer slotIterator.Close()
+
+	for slotIterator.HasNext() {
+		queryResponse, err := slotIterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		slot := HotBalanceSlot{}
+		if err := json.Unmarshal(queryResponse.Value, &slot); err != nil || slot.UserId == "" {
+			discrepancies = append(discrepancies, AuditDiscrepancy{Key: queryResponse.Key, Message: "分割残高データの形式が不正です"})
+			continue
+		}
+		if slot.Amount < 0 {
+			discrepancies = append(discrepancies, AuditDiscrepancy{Key: queryResponse.Key, Message: "分割残高が負の値です"})
+		}
+		summary := s.getAuditSummary(summaries, DefaultTokenType)
+		summary.Circulating += float64(slot.Amount)
+	}
+
+	return summaries, discrepancies, nil
+}
+
+// 台帳全体の発行額と残高の整合性を監査する
+// queryの場合はどのpeerでも同じ結果となり、トランザクションとして実行した場合は監査人の証明書とともにレポートを記録する
+func (s *SmartContract) auditLedger(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	summaries, discrepancies, err := s.collectAuditSummaries(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ポイント種別毎の発行額と流通額の一致チェック
+	tokenTypes := []string{}
+	for tokenType := range summaries {
+		tokenTypes = append(tokenTypes, tokenType)
+	}
+	sort.Strings(tokenTypes)
+
+	// 監査人を証明書で特定できるよう、MSP IDと証明書もレポートに含める
+	mspId, _ := cid.GetMSPID(APIstub)
+	report := AuditReport{
+		AuditedAt:     s.getTxTime(APIstub).Format(DateTimeFormat),
+		AuditorId:     s.getInvokerId(APIstub),
+		AuditorMspId:  mspId,
+		AuditorCert:   s.getInvokerCertPem(APIstub),
+		TxId:          APIstub.GetTxID(),
+		Summaries:     []AuditTokenSummary{},
+		Discrepancies: discrepancies,
+	}
+	for _, tokenType := range tokenTypes {
+		summary := summaries[tokenType]
+		summary.Difference = summary.Circulating - summary.Issued
+		if math.Abs(summary.Difference) > AuditTolerance {
+			report.Discrepancies = append(report.Discrepancies, AuditDiscrepancy{
+				Key:     s.makeTokenTypeKey(tokenType),
+				Message: fmt.Sprintf("発行額と流通額が一致しません(差額: %.3f)", summary.Difference),
+			})
+		}
+		report.Summaries = append(report.Summaries, *summary)
+	}
+	report.Passed = len(report.Discrepancies) == 0
+
+	// 監査人が結果を照合できるようレポートのダイジェストを付与する
+	// ダイジェストは改ざん検知用で署名ではない(トランザクションとして実行した場合の監査人の署名はトランザクション自体に残る)
+	reportAsBytes, _ := json.Marshal(report)
+	digest := sha256.Sum256(reportAsBytes)
+
+	record := AuditRecord{Report: report, Digest: hex.EncodeToString(digest[:])}
+	recordAsBytes, _ := json.Marshal(record)
+	APIstub.PutState(s.makeAuditRecordKey(report.TxId), recordAsBytes)
+
+	result := AuditLedgerResult{Status: StatusOk, Report: record.Report, Digest: record.Digest}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// トランザクションとして記録された監査レポートを取得する
+func (s *SmartContract) getAuditReport(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	recordAsBytes, _ := APIstub.GetState(s.makeAuditRecordKey(args[0]))
+	if len(recordAsBytes) == 0 {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "監査レポートが見つかりませんでした")
+	}
+
+	record := AuditRecord{}
+	json.Unmarshal(recordAsBytes, &record)
+
+	result := AuditLedgerResult{Status: StatusOk, Report: record.Report, Digest: record.Digest}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 発行記録の導入前から流通している残高を発行記録として登録する
+// 発行記録を導入した最初のInitでのみ突き合わせ、以降のInit(アップグレード)では何もしない
+// (後から生じた不一致をgenesisとして記録してしまわないよう、差がなくても導入済みの印を残す)
+func (s *SmartContract) initGenesisIssuance(APIstub shim.ChaincodeStubInterface) error {
+	markerKey := s.makeGenesisMarkerKey()
+	if markerAsBytes, _ := APIstub.GetState(markerKey); len(markerAsBytes) != 0 {
+		return nil
+	}
+
+	summaries, _, err := s.collectAuditSummaries(APIstub)
+	if err != nil {
+		return err
+	}
+
+	for tokenType, summary := range summaries {
+		key := s.makeIssuanceKey(GenesisIssuerId + "_" + tokenType)
+
+		difference := summary.Circulating - summary.Issued
+		if math.Abs(difference) <= AuditTolerance {
+			continue
+		}
+
+		record := IssuanceRecord{
+			TxId:      APIstub.GetTxID(),
+			TokenType: tokenType,
+			IssuerId:  GenesisIssuerId,
+			Kind:      IssuanceKindGenesis,
+			Point:     float32(difference),
+			CreatedAt: s.getTxTime(APIstub).Format(DateTimeFormat),
+		}
+		recordAsBytes, _ := json.Marshal(record)
+		APIstub.PutState(key, recordAsBytes)
+	}
+
+	APIstub.PutState(markerKey, []byte(APIstub.GetTxID()))
+
+	return nil
+}
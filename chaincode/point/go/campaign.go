@@ -0,0 +1,398 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+type RewardType string
+
+const (
+	RewardTypeFixed RewardType = "fixed" // イベント毎に固定ポイント
+	RewardTypeRate  RewardType = "rate"  // イベントの金額に対する割合(%)
+)
+
+const campaignIndexName = "campaign~event"
+const campaignUsageIndexName = "campaign~usage"
+const campaignRewardIndexName = "campaign~reward"
+
+// PerUserCapとBudgetは0の場合は無制限とする
+type Campaign struct {
+	CampaignId  string     `json:"campaign_id"`  // "attendance_2018_08"
+	EventType   string     `json:"event_type"`   // "attendance_on_time"
+	RewardType  RewardType `json:"reward_type"`  // "fixed"
+	RewardValue float32    `json:"reward_value"` // 10.000
+	StartAt     string     `json:"start_at"`     // "2018-08-01 00:00:00 UTC"
+	EndAt       string     `json:"end_at"`       // "2018-09-01 00:00:00 UTC"
+	PerUserCap  float32    `json:"per_user_cap"` // 200.000
+	Budget      float32    `json:"budget"`       // 10000.000
+	Paid        float32    `json:"paid"`         // 1230.000
+	ReporterIds []string   `json:"reporter_ids"` // ["kintai_system"] (イベントを報告できる呼び出し元)
+	IsEnded     bool       `json:"is_ended"`     // false
+}
+
+type CampaignReward struct {
+	CampaignId string  `json:"campaign_id"` // "attendance_2018_08"
+	UserId     string  `json:"user_id"`     // "1725"
+	EventId    string  `json:"event_id"`    // "20180801_1725"
+	Point      float32 `json:"price"`       // 10.000
+	TxId       string  `json:"tx_id"`       // "e3b0c442..."
+}
+
+type CampaignResult struct {
+	Status   Status   `json:"status"`
+	Campaign Campaign `json:"campaign"`
+}
+
+type ApplyCampaignResult struct {
+	Status  Status           `json:"status"`
+	Rewards []CampaignReward `json:"rewards"`
+	Balance Balance          `json:"balance"`
+}
+
+// Campaign用Stateキー作成関数
+func (s *SmartContract) makeCampaignKey(campaignId string) string {
+	return "campaign_" + campaignId
+}
+
+// ユーザー毎の累計付与額用Stateキー作成関数
+// キャンペーンIDとユーザーIDの組み合わせが一意になるよう複合キーとする
+func (s *SmartContract) makeCampaignUsageKey(APIstub shim.ChaincodeStubInterface, campaignId string, userId string) string {
+	key, _ := APIstub.CreateCompositeKey(campaignUsageIndexName, []string{campaignId, userId})
+	return key
+}
+
+// 付与済みイベント用Stateキー作成関数
+// キャンペーンIDとイベントIDの組み合わせが一意になるよう複合キーとする
+func (s *SmartContract) makeCampaignRewardKey(APIstub shim.ChaincodeStubInterface, campaignId string, eventId string) string {
+	key, _ := APIstub.CreateCompositeKey(campaignRewardIndexName, []string{campaignId, eventId})
+	return key
+}
+
+// 指定キャンペーン・指定ユーザーの累計付与額取得
+func (s *SmartContract) getCampaignUsage(APIstub shim.ChaincodeStubInterface, campaignId string, userId string) float32 {
+	used := float32(0)
+
+	usageAsBytes, _ := APIstub.GetState(s.makeCampaignUsageKey(APIstub, campaignId, userId))
+	if len(usageAsBytes) != 0 {
+		json.Unmarshal(usageAsBytes, &used)
+	}
+
+	return used
+}
+
+// 指定キャンペーン・指定イベントが付与済みかどうか
+func (s *SmartContract) isCampaignRewarded(APIstub shim.ChaincodeStubInterface, campaignId string, eventId string) bool {
+	rewardAsBytes, _ := APIstub.GetState(s.makeCampaignRewardKey(APIstub, campaignId, eventId))
+	return len(rewardAsBytes) != 0
+}
+
+// 指定IDのキャンペーン取得
+func (s *SmartContract) getCampaignFromState(APIstub shim.ChaincodeStubInterface, campaignId string) Campaign {
+	campaignAsBytes, _ := APIstub.GetState(s.makeCampaignKey(campaignId))
+	campaign := Campaign{}
+
+	if len(campaignAsBytes) != 0 {
+		json.Unmarshal(campaignAsBytes, &campaign)
+	}
+
+	return campaign
+}
+
+// キャンペーンデータput
+func (s *SmartContract) putCampaign(APIstub shim.ChaincodeStubInterface, campaign Campaign) {
+	campaignAsBytes, _ := json.Marshal(campaign)
+	APIstub.PutState(s.makeCampaignKey(campaign.CampaignId), campaignAsBytes)
+}
+
+// キャンペーンが実施期間中かどうか
+func (s *SmartContract) isActiveCampaign(APIstub shim.ChaincodeStubInterface, campaign Campaign) bool {
+	if campaign.CampaignId == "" || campaign.IsEnded {
+		return false
+	}
+
+	startAt, err := time.Parse(DateTimeFormat, campaign.StartAt)
+	if err != nil {
+		return false
+	}
+	endAt, err := time.Parse(DateTimeFormat, campaign.EndAt)
+	if err != nil {
+		return false
+	}
+
+	now := s.getTxTime(APIstub)
+	return !now.Before(startAt) && now.Before(endAt)
+}
+
+// 呼び出し元がイベントを報告できるかどうか
+func (s *SmartContract) isCampaignReporter(campaign Campaign, invokerId string) bool {
+	if invokerId == AdminUserId {
+		return true
+	}
+	for _, reporterId := range campaign.ReporterIds {
+		if reporterId == invokerId {
+			return true
+		}
+	}
+	return false
+}
+
+// ルールに従って付与額を計算する
+// ユーザー毎の上限と予算の残りを超える分は切り捨てる
+func (s *SmartContract) calcCampaignReward(campaign Campaign, used float32, amount float32) float32 {
+	reward := campaign.RewardValue
+	if campaign.RewardType == RewardTypeRate {
+		reward = amount * campaign.RewardValue / 100
+	}
+
+	if campaign.PerUserCap > 0 && used+reward > campaign.PerUserCap {
+		reward = campaign.PerUserCap - used
+	}
+	if campaign.Budget > 0 && campaign.Paid+reward > campaign.Budget {
+		reward = campaign.Budget - campaign.Paid
+	}
+	if reward < 0 {
+		return 0
+	}
+
+	return reward
+}
+
+// キャンペーンを作成する(管理者のみ)
+// 9つ目以降の引数にイベントを報告できる呼び出し元を列挙する
+func (s *SmartContract) createCampaign(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) < 8 {
+		return shim.Error("Incorrect number of arguments. Expecting 8 or more")
+	}
+
+	rewardValue, err := strconv.ParseFloat(args[3], 32)
+	if err != nil || rewardValue <= 0 {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	startAt, err := time.Parse(DateTimeFormat, args[4])
+	if err != nil {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	endAt, err := time.Parse(DateTimeFormat, args[5])
+	if err != nil {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	perUserCap, err := strconv.ParseFloat(args[6], 32)
+	if err != nil || perUserCap < 0 {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	budget, err := strconv.ParseFloat(args[7], 32)
+	if err != nil || budget < 0 {
+		return shim.Error("Incorrect type of arguments.")
+	}
+
+	campaign := Campaign{
+		CampaignId:  args[0],
+		EventType:   args[1],
+		RewardType:  RewardType(args[2]),
+		RewardValue: float32(rewardValue),
+		StartAt:     startAt.UTC().Format(DateTimeFormat),
+		EndAt:       endAt.UTC().Format(DateTimeFormat),
+		PerUserCap:  float32(perUserCap),
+		Budget:      float32(budget),
+		ReporterIds: args[8:],
+	}
+	if campaign.CampaignId == "" || campaign.EventType == "" {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	if campaign.RewardType != RewardTypeFixed && campaign.RewardType != RewardTypeRate {
+		return shim.Error("Incorrect type of arguments.")
+	}
+
+	if !s.isAdminInvoker(APIstub) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "管理者のみ実行できます")
+	}
+	if !endAt.After(startAt) {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "終了日時が開始日時より前です")
+	}
+	if s.getCampaignFromState(APIstub, campaign.CampaignId).CampaignId != "" {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "登録済みのキャンペーンIDです")
+	}
+
+	s.putCampaign(APIstub, campaign)
+
+	indexKey, _ := APIstub.CreateCompositeKey(campaignIndexName, []string{campaign.EventType, campaign.CampaignId})
+	APIstub.PutState(indexKey, []byte{0x00})
+
+	result := CampaignResult{Status: StatusOk, Campaign: campaign}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// キャンペーンを終了する(管理者のみ)
+func (s *SmartContract) endCampaign(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	if !s.isAdminInvoker(APIstub) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "管理者のみ実行できます")
+	}
+
+	campaign := s.getCampaignFromState(APIstub, args[0])
+	if campaign.CampaignId == "" {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "キャンペーンが見つかりませんでした")
+	}
+
+	campaign.IsEnded = true
+	s.putCampaign(APIstub, campaign)
+
+	indexKey, _ := APIstub.CreateCompositeKey(campaignIndexName, []string{campaign.EventType, campaign.CampaignId})
+	APIstub.DelState(indexKey)
+
+	result := CampaignResult{Status: StatusOk, Campaign: campaign}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+func (s *SmartContract) getCampaign(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	campaign := s.getCampaignFromState(APIstub, args[0])
+
+	result := CampaignResult{Status: StatusOk, Campaign: campaign}
+	if campaign.CampaignId == "" {
+		result.Status = StatusNotFound
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+	return shim.Success(resultAsBytes)
+}
+
+// イベントを報告し、該当する実施中のキャンペーンのルールに従って管理者の残高から付与する
+// 同じイベントIDでの付与はキャンペーン毎に1回のみ
+// 金額は割合で付与するキャンペーンの場合のみ使用する
+// 複数のキャンペーンが該当する場合は合計額を1回の譲渡で付与する
+func (s *SmartContract) applyCampaign(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4")
+	}
+
+	eventType := args[0]
+	userId := args[1]
+	eventId := args[2]
+	amount := float32(0)
+	if len(args) == 4 {
+		val, err := strconv.ParseFloat(args[3], 32)
+		if err != nil || val < 0 {
+			return shim.Error("Incorrect type of arguments.")
+		}
+		amount = float32(val)
+	}
+	if eventId == "" || userId == AdminUserId {
+		return shim.Error("Incorrect type of arguments.")
+	}
+
+	invokerId := s.getInvokerId(APIstub)
+
+	indexIterator, err := APIstub.GetStateByPartialCompositeKey(campaignIndexName, []string{eventType})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer indexIterator.Close()
+
+	campaigns := []Campaign{}
+	rewards := []CampaignReward{}
+	usages := []float32{}
+	total := float32(0)
+	for indexIterator.HasNext() {
+		queryResponse, err := indexIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, keyParts, err := APIstub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(keyParts) != 2 {
+			continue
+		}
+
+		campaign := s.getCampaignFromState(APIstub, keyParts[1])
+		if !s.isActiveCampaign(APIstub, campaign) || !s.isCampaignReporter(campaign, invokerId) {
+			continue
+		}
+
+		// 付与済みのイベントは対象外
+		if s.isCampaignRewarded(APIstub, campaign.CampaignId, eventId) {
+			continue
+		}
+
+		used := s.getCampaignUsage(APIstub, campaign.CampaignId, userId)
+
+		point := s.calcCampaignReward(campaign, used, amount)
+		if point <= 0 {
+			continue
+		}
+
+		campaigns = append(campaigns, campaign)
+		usages = append(usages, used+point)
+		rewards = append(rewards, CampaignReward{
+			CampaignId: campaign.CampaignId,
+			UserId:     userId,
+			EventId:    eventId,
+			Point:      point,
+			TxId:       APIstub.GetTxID(),
+		})
+		total += point
+	}
+
+	if len(rewards) < 1 {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "該当するキャンペーンがありません")
+	}
+
+	_, balance, status, message := s.tryTransfer(APIstub, DefaultTokenType, AdminUserId, userId, total)
+	if status != StatusOk {
+		return s.makeErrorResponce(APIstub, status, message)
+	}
+
+	for i, reward := range rewards {
+		rewardAsBytes, _ := json.Marshal(reward)
+		APIstub.PutState(s.makeCampaignRewardKey(APIstub, reward.CampaignId, eventId), rewardAsBytes)
+
+		usageAsBytes, _ := json.Marshal(usages[i])
+		APIstub.PutState(s.makeCampaignUsageKey(APIstub, reward.CampaignId, userId), usageAsBytes)
+
+		campaign := campaigns[i]
+		campaign.Paid += reward.Point
+		s.putCampaign(APIstub, campaign)
+	}
+
+	result := ApplyCampaignResult{Status: StatusOk, Rewards: rewards, Balance: balance}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
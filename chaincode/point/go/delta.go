@@ -0,0 +1,490 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 高頻度口座の残高・取引明細の差分を記録するインデックス
+// 差分はトランザクション毎に別キーとなるので、同一ブロック内で同じ口座を更新してもMVCCの競合が起きない
+const balanceDeltaIndexName = "balance~delta"
+const transferBillDeltaIndexName = "transfer_bill~delta"
+
+// 高頻度口座の出金に使う分割残高のインデックス
+// 利用可能な残高をあらかじめ複数のキーに分けておき、出金はトランザクション毎に選んだキーから行う
+// 出金時は範囲読み取りを行わないので、残高の過不足の判定がMVCCで正しく検証される
+const hotBalanceSlotIndexName = "balance~slot"
+
+// 高頻度口座の分割残高の数
+const HotBalanceSlotCount = 8
+
+type BalanceDelta struct {
+	TxId   string  `json:"tx_id"`   // "e3b0c442..."
+	UserId string  `json:"user_id"` // "admin"
+	Month  string  `json:"month"`   // "201807"
+	Amount float32 `json:"amount"`  // 300.000
+	Held   float32 `json:"held"`    // 0.000
+	Total  float32 `json:"total"`   // 300.000
+}
+
+type HotBalanceSlot struct {
+	UserId      string  `json:"user_id"`                // "admin"
+	Slot        int     `json:"slot"`                   // 3
+	Amount      float32 `json:"amount"`                 // 1250.000
+	PeriodMonth string  `json:"period_month,omitempty"` // "201808" (最後に更新した月)
+}
+
+type HotAccountResult struct {
+	Status     Status  `json:"status"`
+	UserId     string  `json:"user_id"`
+	IsHot      bool    `json:"is_hot"`
+	Balance    Balance `json:"balance"`
+	DeltaCount int     `json:"delta_count"`
+}
+
+// 高頻度口座設定用Stateキー作成関数
+func (s *SmartContract) makeHotAccountKey(userId string) string {
+	return "hot_account_" + userId
+}
+
+// 高頻度口座の分割残高用Stateキー作成関数
+func (s *SmartContract) makeHotBalanceSlotKey(APIstub shim.ChaincodeStubInterface, userId string, slot int) string {
+	key, _ := APIstub.CreateCompositeKey(hotBalanceSlotIndexName, []string{userId, fmt.Sprintf("%02d", slot)})
+	return key
+}
+
+// 差分で残高を管理する高頻度口座かどうか
+// 管理者は常に高頻度口座とし、デフォルトのポイントのみ対象とする
+func (s *SmartContract) isHotAccount(APIstub shim.ChaincodeStubInterface, tokenType string, userId string) bool {
+	if !s.isDefaultTokenType(tokenType) {
+		return false
+	}
+	if userId == AdminUserId {
+		return true
+	}
+
+	hotAsBytes, _ := APIstub.GetState(s.makeHotAccountKey(userId))
+	return len(hotAsBytes) != 0
+}
+
+// 残高を増減する
+func (s *SmartContract) updateBalance(APIstub shim.ChaincodeStubInterface, balance Balance, amount float32, total float32) Balance {
+	// 同一トランザクションで入出金の両方がある場合に備えて向きもキーに含める
+	direction := "in"
+	if amount < 0 {
+		direction = "out"
+	}
+	return s.changeBalance(APIstub, balance, amount, 0, total, direction)
+}
+
+// 利用可能な残高・仮押さえ額・累計を増減する
+// 高頻度口座は出金を分割残高から行い、それ以外の増減は差分のみ記録する(入金分は分割残高で足りない出金時か集約時に取り込まれる)
+// 高頻度口座の場合の返却値は基準残高のみで、分割残高・未集約の差分を含まない
+// kindは同一トランザクション内で差分のキーが重複しないよう呼び出し側で指定する
+func (s *SmartContract) changeBalance(APIstub shim.ChaincodeStubInterface, balance Balance, amount float32, held float32, total float32, kind string) Balance {
+	if !s.isHotAccount(APIstub, balance.TokenType, balance.UserId) {
+		balance.Amount += amount
+		balance.Held += held
+		balance.Total += total
+		s.putBalance(APIstub, balance)
+		return balance
+	}
+
+	if amount < 0 {
+		balance = s.debitHotAccount(APIstub, balance, -amount)
+		amount = 0
+	}
+	if amount == 0 && held == 0 && total == 0 {
+		return balance
+	}
+
+	delta := BalanceDelta{
+		TxId:   APIstub.GetTxID(),
+		UserId: balance.UserId,
+		Month:  s.getTxTime(APIstub).Format(MonthFormat),
+		Amount: amount,
+		Held:   held,
+		Total:  total,
+	}
+	deltaKey, _ := APIstub.CreateCompositeKey(balanceDeltaIndexName, []string{balance.UserId, delta.TxId, kind})
+	deltaAsBytes, _ := json.Marshal(delta)
+	APIstub.PutState(deltaKey, deltaAsBytes)
+
+	return balance
+}
+
+// 指定ユーザーの未集約の差分を取得する
+// 範囲読み取りとなるので、書き込みを伴う処理では極力使わないこと
+func (s *SmartContract) getBalanceDeltas(APIstub shim.ChaincodeStubInterface, userId string) (map[string]BalanceDelta, error) {
+	deltas := map[string]BalanceDelta{}
+
+	deltaIterator, err := APIstub.GetStateByPartialCompositeKey(balanceDeltaIndexName, []string{userId})
+	if err != nil {
+		return deltas, err
+	}
+	defer deltaIterator.Close()
+
+	for deltaIterator.HasNext() {
+		queryResponse, err := deltaIterator.Next()
+		if err != nil {
+			return deltas, err
+		}
+		delta := BalanceDelta{}
+		json.Unmarshal(queryResponse.Value, &delta)
+		deltas[queryResponse.Key] = delta
+	}
+
+	return deltas, nil
+}
+
+// 指定ユーザー・指定番号の分割残高を取得する
+func (s *SmartContract) getHotBalanceSlot(APIstub shim.ChaincodeStubInterface, userId string, slot int) HotBalanceSlot {
+	slotAsBytes, _ := APIstub.GetState(s.makeHotBalanceSlotKey(APIstub, userId, slot))
+	result := HotBalanceSlot{UserId: userId, Slot: slot}
+
+	if len(slotAsBytes) != 0 {
+		json.Unmarshal(slotAsBytes, &result)
+	}
+
+	return result
+}
+
+// 分割残高データput
+// 月が変わって最初の更新では月初時点の残高を記録しておく(月末のスナップショットで使う)
+func (s *SmartContract) putHotBalanceSlot(APIstub shim.ChaincodeStubInterface, slot HotBalanceSlot) {
+	month := s.getTxTime(APIstub).Format(MonthFormat)
+	if slot.PeriodMonth != month {
+		stored := s.getHotBalanceSlot(APIstub, slot.UserId, slot.Slot)
+		if stored.PeriodMonth != month {
+			opening := BalanceOpening{Month: month, Amount: stored.Amount}
+			s.putBalanceOpening(APIstub, DefaultTokenType, slot.UserId, s.makeSlotOpeningRecord(slot.Slot), opening)
+		}
+		slot.PeriodMonth = month
+	}
+
+	slotAsBytes, _ := json.Marshal(slot)
+	APIstub.PutState(s.makeHotBalanceSlotKey(APIstub, slot.UserId, slot.Slot), slotAsBytes)
+}
+
+// 指定ユーザーの分割残高をすべて取得する
+// 範囲読み取りとなるので、出金処理では使わないこと
+func (s *SmartContract) getHotBalanceSlots(APIstub shim.ChaincodeStubInterface, userId string) (map[string]HotBalanceSlot, error) {
+	slots := map[string]HotBalanceSlot{}
+
+	slotIterator, err := APIstub.GetStateByPartialCompositeKey(hotBalanceSlotIndexName, []string{userId})
+	if err != nil {
+		return slots, err
+	}
+	defer slotIterator.Close()
+
+	for slotIterator.HasNext() {
+		queryResponse, err := slotIterator.Next()
+		if err != nil {
+			return slots, err
+		}
+		slot := HotBalanceSlot{}
+		json.Unmarshal(queryResponse.Value, &slot)
+		slots[queryResponse.Key] = slot
+	}
+
+	return slots, nil
+}
+
+// 高頻度口座の出金元とする分割残高を選ぶ
+// TxIDから決めた番号から順に1件ずつ読み、足りた時点で打ち切る(分割残高で足りなければ基準残高も使う)
+// 出金後の分割残高と基準残高からの出金額を返し、残高が足りなければfalseを返す
+func (s *SmartContract) planHotDebit(APIstub shim.ChaincodeStubInterface, balance Balance, total float32) ([]HotBalanceSlot, float32, bool) {
+	hash := fnv.New32a()
+	hash.Write([]byte(APIstub.GetTxID()))
+	start := int(hash.Sum32() % HotBalanceSlotCount)
+
+	slots := []HotBalanceSlot{}
+	remaining := total
+	for i := 0; i < HotBalanceSlotCount && remaining > 0; i++ {
+		slot := s.getHotBalanceSlot(APIstub, balance.UserId, (start+i)%HotBalanceSlotCount)
+		if slot.Amount <= 0 {
+			continue
+		}
+		debit := remaining
+		if slot.Amount < debit {
+			debit = slot.Amount
+		}
+		slot.Amount -= debit
+		remaining -= debit
+		slots = append(slots, slot)
+	}
+
+	if remaining <= 0 {
+		return slots, 0, true
+	}
+	if remaining <= balance.Amount {
+		return slots, remaining, true
+	}
+	return nil, 0, false
+}
+
+// 高頻度口座から出金する
+// 残高のチェックはhasEnoughBalanceで事前に行うこと
+// 分割残高と基準残高で足りない場合は未集約の差分を基準残高に集約してから出金する
+// (集約後の残高は次のcompactBalanceまで基準残高に置かれるため、その間の出金は基準残高で競合する)
+// (GetStateは同一トランザクション内の書き込みを返さないので、1トランザクションにつき1回のみ呼び出すこと)
+func (s *SmartContract) debitHotAccount(APIstub shim.ChaincodeStubInterface, balance Balance, total float32) Balance {
+	slots, fromBase, ok := s.planHotDebit(APIstub, balance, total)
+	if !ok {
+		balance, _ = s.compactHotBalance(APIstub, balance, false)
+		balance.Amount -= total
+		s.putBalance(APIstub, balance)
+		return balance
+	}
+	for _, slot := range slots {
+		s.putHotBalanceSlot(APIstub, slot)
+	}
+	if fromBase > 0 {
+		balance.Amount -= fromBase
+		s.putBalance(APIstub, balance)
+	}
+
+	return balance
+}
+
+// 基準残高に分割残高と未集約の差分を加えた残高を返す(参照用)
+// 高頻度口座の設定を解除した後に残っている差分も含める
+func (s *SmartContract) addPendingDeltas(APIstub shim.ChaincodeStubInterface, balance Balance) Balance {
+	if !s.isValidBalance(balance) || !s.isDefaultTokenType(balance.TokenType) {
+		return balance
+	}
+
+	slots, _ := s.getHotBalanceSlots(APIstub, balance.UserId)
+	for _, slot := range slots {
+		balance.Amount += slot.Amount
+	}
+
+	deltas, _ := s.getBalanceDeltas(APIstub, balance.UserId)
+	for _, delta := range deltas {
+		balance.Amount += delta.Amount
+		balance.Held += delta.Held
+		balance.Total += delta.Total
+	}
+
+	return balance
+}
+
+// 分割残高と未集約の差分を基準残高に集約してputする
+// 高頻度口座は集約後に利用可能な残高を分割残高に均等に割り当て直す
+// 月末のスナップショットで使えるよう、削除・再作成する分割残高の月初時点の残高と、集約した前月以前の差分を記録しておく
+// 集約後の残高(分割残高を含む)と取り込んだ差分の件数を返す
+func (s *SmartContract) compactHotBalance(APIstub shim.ChaincodeStubInterface, balance Balance, isHot bool) (Balance, int) {
+	month := s.getTxTime(APIstub).Format(MonthFormat)
+
+	slots, _ := s.getHotBalanceSlots(APIstub, balance.UserId)
+	for key, slot := range slots {
+		if slot.PeriodMonth != month {
+			opening := BalanceOpening{Month: month, Amount: slot.Amount}
+			s.putBalanceOpening(APIstub, DefaultTokenType, balance.UserId, s.makeSlotOpeningRecord(slot.Slot), opening)
+		}
+		balance.Amount += slot.Amount
+		APIstub.DelState(key)
+	}
+
+	folded := s.getBalanceOpening(APIstub, DefaultTokenType, balance.UserId, BalanceOpeningDelta, month)
+	if folded.Deltas == nil {
+		folded.Deltas = map[string]float32{}
+	}
+	deltas, _ := s.getBalanceDeltas(APIstub, balance.UserId)
+	foldedCount := 0
+	for key, delta := range deltas {
+		if delta.Month < month {
+			folded.Amount += delta.Amount + delta.Held
+			folded.Deltas[delta.Month] += delta.Amount + delta.Held
+			foldedCount++
+		}
+		balance.Amount += delta.Amount
+		balance.Held += delta.Held
+		balance.Total += delta.Total
+		APIstub.DelState(key)
+	}
+	if foldedCount > 0 {
+		s.putBalanceOpening(APIstub, DefaultTokenType, balance.UserId, BalanceOpeningDelta, folded)
+	}
+
+	if !isHot {
+		s.putBalance(APIstub, balance)
+		balance.PeriodMonth = month
+		return balance, len(deltas)
+	}
+
+	// 分割残高を新たに作成する場合は月初時点の残高を0として記録する
+	pool := balance.Amount
+	share := pool / HotBalanceSlotCount
+	for i := 0; i < HotBalanceSlotCount; i++ {
+		if _, ok := slots[s.makeHotBalanceSlotKey(APIstub, balance.UserId, i)]; !ok {
+			opening := BalanceOpening{Month: month, Amount: 0}
+			s.putBalanceOpening(APIstub, DefaultTokenType, balance.UserId, s.makeSlotOpeningRecord(i), opening)
+		}
+		slot := HotBalanceSlot{UserId: balance.UserId, Slot: i, Amount: share, PeriodMonth: month}
+		// 端数は最後の分割残高に寄せる
+		if i == HotBalanceSlotCount-1 {
+			slot.Amount = pool - share*(HotBalanceSlotCount-1)
+		}
+		s.putHotBalanceSlot(APIstub, slot)
+	}
+
+	base := balance
+	base.Amount = 0
+	s.putBalance(APIstub, base)
+	balance.PeriodMonth = month
+
+	return balance, len(deltas)
+}
+
+// 残高が足りているかチェックする
+// 高頻度口座は分割残高(足りなければ基準残高)で判定し、それでも足りない場合のみ未集約の差分を含めて判定する
+// (差分の範囲読み取りは競合の原因となるため、残高不足時に限る)
+func (s *SmartContract) hasEnoughBalance(APIstub shim.ChaincodeStubInterface, balance Balance, total float32) bool {
+	if !s.isHotAccount(APIstub, balance.TokenType, balance.UserId) {
+		return total <= balance.Amount
+	}
+	if _, _, ok := s.planHotDebit(APIstub, balance, total); ok {
+		return true
+	}
+	return total <= s.addPendingDeltas(APIstub, balance).Amount
+}
+
+// 高頻度口座の取引明細をトランザクション毎のキーに記録する
+func (s *SmartContract) putTransferBillDelta(APIstub shim.ChaincodeStubInterface, userId string, month string, history TransferHistory) {
+	record := TransferHistoryWithTimestamp{
+		TransferHistory: history,
+		TxId:            APIstub.GetTxID(),
+		CreatedAt:       s.getTxTime(APIstub).Format(DateTimeFormat),
+	}
+	key, _ := APIstub.CreateCompositeKey(transferBillDeltaIndexName, []string{userId, month, record.TxId})
+	recordAsBytes, _ := json.Marshal(record)
+	APIstub.PutState(key, recordAsBytes)
+}
+
+// 高頻度口座の指定月の取引明細を取得する
+func (s *SmartContract) getTransferBillDeltas(APIstub shim.ChaincodeStubInterface, userId string, month string) ([]TransferHistoryWithTimestamp, error) {
+	var histories []TransferHistoryWithTimestamp
+
+	billIterator, err := APIstub.GetStateByPartialCompositeKey(transferBillDeltaIndexName, []string{userId, month})
+	if err != nil {
+		return nil, err
+	}
+	defer billIterator.Close()
+
+	for billIterator.HasNext() {
+		queryResponse, err := billIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		history := TransferHistoryWithTimestamp{}
+		json.Unmarshal(queryResponse.Value, &history)
+		histories = append(histories, history)
+	}
+
+	return histories, nil
+}
+
+// 高頻度口座の差分を基準残高に集約する(管理者のみ)
+// 定期的にスケジューラなどから呼び出すことを想定
+func (s *SmartContract) compactBalance(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	userId := args[0]
+
+	if !s.isAdminInvoker(APIstub) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "管理者のみ実行できます")
+	}
+
+	balance := s.getUserBalance(APIstub, userId)
+	if !s.isValidBalance(balance) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "残高が見つかりませんでした")
+	}
+
+	// 差分を取り込んだ上で、高頻度口座は利用可能な残高を分割残高に割り当て直す
+	isHot := s.isHotAccount(APIstub, DefaultTokenType, userId)
+	balance, deltaCount := s.compactHotBalance(APIstub, balance, isHot)
+
+	result := HotAccountResult{
+		Status:     StatusOk,
+		UserId:     userId,
+		IsHot:      isHot,
+		Balance:    balance,
+		DeltaCount: deltaCount,
+	}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 口座を高頻度口座に設定・解除する(管理者のみ)
+// 設定時は利用可能な残高を分割残高に割り当て、解除時は分割残高と未集約の差分を基準残高に取り込む
+// 高頻度口座は日毎の譲渡実績を記録できないので、1日あたりの上限が適用される口座は設定できない
+func (s *SmartContract) setHotAccount(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	userId := args[0]
+	isHot, err := strconv.ParseBool(args[1])
+	if err != nil {
+		return shim.Error("Incorrect type of arguments.")
+	}
+
+	if !s.isAdminInvoker(APIstub) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "管理者のみ実行できます")
+	}
+	if userId == AdminUserId {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "管理者は常に高頻度口座です")
+	}
+
+	if isHot && s.hasDailyTransferLimit(APIstub, userId) {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "1日あたりの譲渡上限が適用される口座は高頻度口座にできません")
+	}
+
+	// 差分の基準となる残高データを用意する
+	balance := s.getUserBalance(APIstub, userId)
+	if !s.isValidBalance(balance) {
+		balance = s.makeEmptyBalance(userId)
+	}
+
+	if isHot {
+		APIstub.PutState(s.makeHotAccountKey(userId), []byte("true"))
+	} else {
+		APIstub.DelState(s.makeHotAccountKey(userId))
+	}
+	balance, deltaCount := s.compactHotBalance(APIstub, balance, isHot)
+
+	result := HotAccountResult{Status: StatusOk, UserId: userId, IsHot: isHot, Balance: balance, DeltaCount: deltaCount}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
@@ -0,0 +1,340 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+type HoldStatus string
+
+const (
+	HoldStatusHeld     HoldStatus = "held"
+	HoldStatusCaptured HoldStatus = "captured"
+	HoldStatusReleased HoldStatus = "released"
+	HoldStatusExpired  HoldStatus = "expired"
+)
+
+// 有効期限の指定がない場合の仮押さえ期間
+const DefaultHoldDuration = 24 * time.Hour
+
+const holdIndexName = "hold~user"
+
+type Hold struct {
+	HoldId     string     `json:"hold_id"`     // "e3b0c442..."(作成時のTxID)
+	UserId     string     `json:"user_id"`     // "1725"
+	Amount     float32    `json:"amount"`      // 300.000 (仮押さえ中の残量)
+	Captured   float32    `json:"captured"`    // 0.000
+	PayeeId    string     `json:"payee_id"`    // "shop" (作成時に指定し、確定はこの支払先か管理者のみ行える)
+	HoldStatus HoldStatus `json:"hold_status"` // "held"
+	CreatedAt  string     `json:"created_at"`  // "2018-07-01 20:32:11 UTC"
+	ExpiresAt  string     `json:"expires_at"`  // "2018-07-02 20:32:11 UTC"
+}
+
+type HoldResult struct {
+	Status  Status  `json:"status"`
+	Hold    Hold    `json:"hold"`
+	Balance Balance `json:"balance"`
+}
+
+type CaptureHoldResult struct {
+	Status       Status  `json:"status"`
+	Hold         Hold    `json:"hold"`
+	Balance      Balance `json:"balance"`
+	PayeeBalance Balance `json:"payee_balance"`
+}
+
+// Hold用Stateキー作成関数
+func (s *SmartContract) makeHoldKey(holdId string) string {
+	return "hold_" + holdId
+}
+
+// 指定IDの仮押さえ取得
+func (s *SmartContract) getHold(APIstub shim.ChaincodeStubInterface, holdId string) Hold {
+	holdAsBytes, _ := APIstub.GetState(s.makeHoldKey(holdId))
+	hold := Hold{}
+
+	if len(holdAsBytes) != 0 {
+		json.Unmarshal(holdAsBytes, &hold)
+	}
+
+	return hold
+}
+
+// 仮押さえデータput
+// 仮押さえ中のものだけユーザー毎のインデックスに載せる
+func (s *SmartContract) putHold(APIstub shim.ChaincodeStubInterface, hold Hold) {
+	holdAsBytes, _ := json.Marshal(hold)
+	APIstub.PutState(s.makeHoldKey(hold.HoldId), holdAsBytes)
+
+	indexKey, _ := APIstub.CreateCompositeKey(holdIndexName, []string{hold.UserId, hold.HoldId})
+	if hold.HoldStatus == HoldStatusHeld {
+		APIstub.PutState(indexKey, []byte{0x00})
+	} else {
+		APIstub.DelState(indexKey)
+	}
+}
+
+// 指定ユーザーの仮押さえ中の一覧取得
+func (s *SmartContract) getActiveHolds(APIstub shim.ChaincodeStubInterface, userId string) []Hold {
+	holds := []Hold{}
+	if userId == "" {
+		return holds
+	}
+
+	indexIterator, err := APIstub.GetStateByPartialCompositeKey(holdIndexName, []string{userId})
+	if err != nil {
+		return holds
+	}
+	defer indexIterator.Close()
+
+	for indexIterator.HasNext() {
+		queryResponse, err := indexIterator.Next()
+		if err != nil {
+			break
+		}
+		_, keyParts, err := APIstub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(keyParts) != 2 {
+			continue
+		}
+		holds = append(holds, s.getHold(APIstub, keyParts[1]))
+	}
+
+	return holds
+}
+
+// 仮押さえが期限切れかどうか
+func (s *SmartContract) isExpiredHold(APIstub shim.ChaincodeStubInterface, hold Hold) bool {
+	expiresAt, err := time.Parse(DateTimeFormat, hold.ExpiresAt)
+	if err != nil {
+		return false
+	}
+	return !s.getTxTime(APIstub).Before(expiresAt)
+}
+
+// 仮押さえ分を利用可能な残高に戻す
+func (s *SmartContract) restoreHeldAmount(balance Balance, hold Hold) Balance {
+	balance.Held -= hold.Amount
+	balance.Amount += hold.Amount
+	return balance
+}
+
+// 期限切れの仮押さえを解放して残高を更新する
+// 仮押さえはデフォルトのポイントのみ対象
+// 高頻度口座は差分として記録するので、解放分は集約後に利用可能となる
+func (s *SmartContract) releaseExpiredHolds(APIstub shim.ChaincodeStubInterface, balance Balance) Balance {
+	if !s.isValidBalance(balance) || !s.isDefaultTokenType(balance.TokenType) {
+		return balance
+	}
+
+	for _, hold := range s.getActiveHolds(APIstub, balance.UserId) {
+		if !s.isExpiredHold(APIstub, hold) {
+			continue
+		}
+		balance = s.changeBalance(APIstub, balance, hold.Amount, -hold.Amount, 0, "expire_"+hold.HoldId)
+		hold.HoldStatus = HoldStatusExpired
+		s.putHold(APIstub, hold)
+	}
+
+	return balance
+}
+
+// 残高の一部を支払先を指定して仮押さえする(本人か管理者のみ)
+func (s *SmartContract) createHold(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4")
+	}
+
+	userId := args[0]
+	payeeId := args[1]
+	val, err := strconv.ParseFloat(args[2], 32)
+	if err != nil || val <= 0 {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	point := float32(val)
+
+	if s.getInvokerId(APIstub) != userId && !s.isAdminInvoker(APIstub) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "本人か管理者のみ実行できます")
+	}
+	if payeeId == "" {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	if userId == payeeId {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "仮押さえ元と支払先が同じです")
+	}
+
+	now := s.getTxTime(APIstub)
+	expiresAt := now.Add(DefaultHoldDuration)
+	if len(args) == 4 {
+		expiresAt, err = time.Parse(DateTimeFormat, args[3])
+		if err != nil {
+			return shim.Error("Incorrect type of arguments.")
+		}
+	}
+	if !expiresAt.After(now) {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "有効期限が過去の日時です")
+	}
+
+	balance := s.getUserBalance(APIstub, userId)
+	if !s.isValidBalance(balance) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "残高が見つかりませんでした")
+	}
+	if status, message := s.checkOutgoing(balance); status != StatusOk {
+		return s.makeErrorResponce(APIstub, status, message)
+	}
+	// 管理者の高額の仮押さえは確定で承認を経ずに譲渡できてしまうので作成時にも止める
+	if status, message := s.checkAdminDebit(APIstub, DefaultTokenType, userId, point); status != StatusOk {
+		return s.makeErrorResponce(APIstub, status, message)
+	}
+	balance = s.releaseExpiredHolds(APIstub, balance)
+
+	if !s.hasEnoughBalance(APIstub, balance, point) {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "残高が足りません")
+	}
+
+	hold := Hold{
+		HoldId:     APIstub.GetTxID(),
+		UserId:     userId,
+		Amount:     point,
+		PayeeId:    payeeId,
+		HoldStatus: HoldStatusHeld,
+		CreatedAt:  now.Format(DateTimeFormat),
+		ExpiresAt:  expiresAt.UTC().Format(DateTimeFormat),
+	}
+	s.putHold(APIstub, hold)
+
+	balance = s.changeBalance(APIstub, balance, -point, point, 0, "hold")
+
+	result := HoldResult{Status: StatusOk, Hold: hold, Balance: balance}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 仮押さえを確定して作成時に指定した支払先へ譲渡する(支払先か管理者のみ)
+// 金額を省略した場合は全額、一部の場合は残りを解放する
+func (s *SmartContract) captureHold(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+
+	holdId := args[0]
+
+	hold := s.getHold(APIstub, holdId)
+	if hold.HoldId == "" {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "仮押さえが見つかりませんでした")
+	}
+	payeeId := hold.PayeeId
+	if payeeId == "" || (s.getInvokerId(APIstub) != payeeId && !s.isAdminInvoker(APIstub)) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "仮押さえの支払先か管理者のみ実行できます")
+	}
+	if hold.HoldStatus != HoldStatusHeld {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "仮押さえはすでに終了しています")
+	}
+
+	total := hold.Amount
+	if len(args) == 2 {
+		val, err := strconv.ParseFloat(args[1], 32)
+		if err != nil || val <= 0 {
+			return shim.Error("Incorrect type of arguments.")
+		}
+		total = float32(val)
+	}
+	if total > hold.Amount {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "仮押さえの金額を超えています")
+	}
+
+	balance := s.getUserBalance(APIstub, hold.UserId)
+
+	// 期限切れなら解放のみ行う
+	if s.isExpiredHold(APIstub, hold) {
+		s.releaseExpiredHolds(APIstub, balance)
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "仮押さえの有効期限が切れています")
+	}
+
+	// 凍結・解約チェック
+	if status, message := s.checkOutgoing(balance); status != StatusOk {
+		return s.makeErrorResponce(APIstub, status, message)
+	}
+
+	// 支払先の凍結・解約チェック
+	if status, message := s.checkIncoming(s.getUserBalance(APIstub, payeeId)); status != StatusOk {
+		return s.makeErrorResponce(APIstub, status, message)
+	}
+
+	// 複数承認・譲渡上限チェック
+	if status, message := s.checkAdminDebit(APIstub, DefaultTokenType, hold.UserId, total); status != StatusOk {
+		return s.makeErrorResponce(APIstub, status, message)
+	}
+	if status, message := s.checkTransferLimit(APIstub, hold.UserId, total); status != StatusOk {
+		return s.makeErrorResponce(APIstub, status, message)
+	}
+	s.addTransferUsage(APIstub, hold.UserId, total)
+
+	// 確定分を差し引き、残りは利用可能な残高に戻す
+	balance = s.changeBalance(APIstub, balance, hold.Amount-total, -hold.Amount, 0, "capture")
+
+	// 支払先の残高増加と取引明細・返金用の取引データの記録
+	payeeBalance := s.creditTransfer(APIstub, balance, payeeId, total, "")
+
+	hold.Captured = total
+	hold.Amount = 0
+	hold.HoldStatus = HoldStatusCaptured
+	s.putHold(APIstub, hold)
+
+	result := CaptureHoldResult{Status: StatusOk, Hold: hold, Balance: balance, PayeeBalance: payeeBalance}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 仮押さえを取り消して利用可能な残高に戻す
+func (s *SmartContract) releaseHold(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	hold := s.getHold(APIstub, args[0])
+	if hold.HoldId == "" {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "仮押さえが見つかりませんでした")
+	}
+	if hold.HoldStatus != HoldStatusHeld {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "仮押さえはすでに終了しています")
+	}
+
+	balance := s.getUserBalance(APIstub, hold.UserId)
+	balance = s.changeBalance(APIstub, balance, hold.Amount, -hold.Amount, 0, "release")
+
+	hold.HoldStatus = HoldStatusReleased
+	s.putHold(APIstub, hold)
+
+	result := HoldResult{Status: StatusOk, Hold: hold, Balance: balance}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
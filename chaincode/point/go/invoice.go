@@ -0,0 +1,283 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+type InvoiceStatus string
+
+const (
+	InvoiceStatusOpen      InvoiceStatus = "open"
+	InvoiceStatusPaid      InvoiceStatus = "paid"
+	InvoiceStatusCancelled InvoiceStatus = "cancelled"
+	InvoiceStatusExpired   InvoiceStatus = "expired"
+)
+
+const invoiceIndexName = "invoice~merchant"
+
+type Invoice struct {
+	InvoiceId     string        `json:"invoice_id"`     // "e3b0c442..."(作成時のTxID)
+	MerchantId    string        `json:"merchant_id"`    // "cafeteria"
+	Amount        float32       `json:"amount"`         // 450.000
+	Memo          string        `json:"memo"`           // "日替わり定食"
+	InvoiceStatus InvoiceStatus `json:"invoice_status"` // "open"
+	PayerId       string        `json:"payer_id"`       // "1725"
+	PaidTxId      string        `json:"paid_tx_id"`     // "a1b2c3d4..."
+	CreatedAt     string        `json:"created_at"`     // "2018-07-01 12:00:00 UTC"
+	ExpiresAt     string        `json:"expires_at"`     // "2018-07-01 13:00:00 UTC"
+	PaidAt        string        `json:"paid_at"`        // "2018-07-01 12:05:11 UTC"
+}
+
+type InvoiceResult struct {
+	Status  Status  `json:"status"`
+	Invoice Invoice `json:"invoice"`
+}
+
+type PayInvoiceResult struct {
+	Status          Status  `json:"status"`
+	Invoice         Invoice `json:"invoice"`
+	FromUserBalance Balance `json:"from_user_balance"`
+	ToUserBalance   Balance `json:"to_user_balance"`
+}
+
+type GetMerchantInvoicesResult struct {
+	Status   Status    `json:"status"`
+	Invoices []Invoice `json:"invoices"`
+}
+
+// Invoice用Stateキー作成関数
+func (s *SmartContract) makeInvoiceKey(invoiceId string) string {
+	return "invoice_" + invoiceId
+}
+
+// 指定IDの請求データ取得
+// 期限切れの未払い請求は期限切れとして返す
+func (s *SmartContract) getInvoiceFromState(APIstub shim.ChaincodeStubInterface, invoiceId string) Invoice {
+	invoiceAsBytes, _ := APIstub.GetState(s.makeInvoiceKey(invoiceId))
+	invoice := Invoice{}
+
+	if len(invoiceAsBytes) != 0 {
+		json.Unmarshal(invoiceAsBytes, &invoice)
+	}
+
+	if invoice.InvoiceStatus == InvoiceStatusOpen {
+		expiresAt, err := time.Parse(DateTimeFormat, invoice.ExpiresAt)
+		if err == nil && !s.getTxTime(APIstub).Before(expiresAt) {
+			invoice.InvoiceStatus = InvoiceStatusExpired
+		}
+	}
+
+	return invoice
+}
+
+// 請求データput
+func (s *SmartContract) putInvoice(APIstub shim.ChaincodeStubInterface, invoice Invoice) {
+	invoiceAsBytes, _ := json.Marshal(invoice)
+	APIstub.PutState(s.makeInvoiceKey(invoice.InvoiceId), invoiceAsBytes)
+}
+
+// 加盟店の請求を作成する(加盟店本人か管理者のみ)
+func (s *SmartContract) createInvoice(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	merchantId := args[0]
+	val, err := strconv.ParseFloat(args[1], 32)
+	if err != nil || val <= 0 {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	memo := args[2]
+	expiresAt, err := time.Parse(DateTimeFormat, args[3])
+	if err != nil {
+		return shim.Error("Incorrect type of arguments.")
+	}
+
+	invokerId := s.getInvokerId(APIstub)
+	if invokerId != merchantId && invokerId != AdminUserId {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "請求を作成する権限がありません")
+	}
+
+	now := s.getTxTime(APIstub)
+	if !expiresAt.After(now) {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "有効期限が過去の日時です")
+	}
+
+	invoice := Invoice{
+		InvoiceId:     APIstub.GetTxID(),
+		MerchantId:    merchantId,
+		Amount:        float32(val),
+		Memo:          memo,
+		InvoiceStatus: InvoiceStatusOpen,
+		CreatedAt:     now.Format(DateTimeFormat),
+		ExpiresAt:     expiresAt.UTC().Format(DateTimeFormat),
+	}
+	s.putInvoice(APIstub, invoice)
+
+	indexKey, _ := APIstub.CreateCompositeKey(invoiceIndexName, []string{merchantId, invoice.InvoiceId})
+	APIstub.PutState(indexKey, []byte{0x00})
+
+	result := InvoiceResult{Status: StatusOk, Invoice: invoice}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 呼び出し元ユーザーの残高から請求を支払う
+func (s *SmartContract) payInvoice(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	payerId := s.getInvokerId(APIstub)
+
+	invoice := s.getInvoiceFromState(APIstub, args[0])
+	if invoice.InvoiceId == "" {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "請求が見つかりませんでした")
+	}
+	if invoice.InvoiceStatus != InvoiceStatusOpen {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "支払いできない請求です("+string(invoice.InvoiceStatus)+")")
+	}
+	if payerId == "" || payerId == invoice.MerchantId {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "支払元と請求元が同じです")
+	}
+
+	fromBalance, toBalance, status, message := s.tryTransfer(APIstub, DefaultTokenType, payerId, invoice.MerchantId, invoice.Amount)
+	if status != StatusOk {
+		return s.makeErrorResponce(APIstub, status, message)
+	}
+
+	invoice.InvoiceStatus = InvoiceStatusPaid
+	invoice.PayerId = payerId
+	invoice.PaidTxId = APIstub.GetTxID()
+	invoice.PaidAt = s.getTxTime(APIstub).Format(DateTimeFormat)
+	s.putInvoice(APIstub, invoice)
+
+	result := PayInvoiceResult{
+		Status:          StatusOk,
+		Invoice:         invoice,
+		FromUserBalance: fromBalance,
+		ToUserBalance:   toBalance,
+	}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 未払いの請求を取り消す(加盟店本人か管理者のみ)
+func (s *SmartContract) cancelInvoice(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	invoice := s.getInvoiceFromState(APIstub, args[0])
+	if invoice.InvoiceId == "" {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "請求が見つかりませんでした")
+	}
+
+	invokerId := s.getInvokerId(APIstub)
+	if invokerId != invoice.MerchantId && invokerId != AdminUserId {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "請求を取り消す権限がありません")
+	}
+	if invoice.InvoiceStatus != InvoiceStatusOpen && invoice.InvoiceStatus != InvoiceStatusExpired {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "取り消しできない請求です("+string(invoice.InvoiceStatus)+")")
+	}
+
+	invoice.InvoiceStatus = InvoiceStatusCancelled
+	s.putInvoice(APIstub, invoice)
+
+	result := InvoiceResult{Status: StatusOk, Invoice: invoice}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+func (s *SmartContract) getInvoice(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	invoice := s.getInvoiceFromState(APIstub, args[0])
+
+	result := InvoiceResult{Status: StatusOk, Invoice: invoice}
+	if invoice.InvoiceId == "" {
+		result.Status = StatusNotFound
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+	return shim.Success(resultAsBytes)
+}
+
+// 加盟店の請求一覧を取得する
+// 2つ目の引数でステータス(open/paid/cancelled/expired)を絞り込める
+func (s *SmartContract) getMerchantInvoices(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+
+	merchantId := args[0]
+	filterStatus := InvoiceStatus("")
+	if len(args) == 2 {
+		filterStatus = InvoiceStatus(args[1])
+	}
+
+	indexIterator, err := APIstub.GetStateByPartialCompositeKey(invoiceIndexName, []string{merchantId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer indexIterator.Close()
+
+	var invoices []Invoice
+	for indexIterator.HasNext() {
+		queryResponse, err := indexIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, keyParts, err := APIstub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(keyParts) != 2 {
+			continue
+		}
+		invoice := s.getInvoiceFromState(APIstub, keyParts[1])
+		if filterStatus != "" && invoice.InvoiceStatus != filterStatus {
+			continue
+		}
+		invoices = append(invoices, invoice)
+	}
+
+	result := GetMerchantInvoicesResult{Status: StatusOk, Invoices: invoices}
+	if len(invoices) < 1 {
+		result.Status = StatusNotFound
+	}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
@@ -0,0 +1,254 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const DateFormat = "20060102"
+
+// 各上限値は0の場合は無制限とする
+type TransferLimit struct {
+	UserId         string  `json:"user_id"`           // "1725"(デフォルトの上限は空)
+	MaxPerTransfer float32 `json:"max_per_transfer"`  // 500.000
+	MaxPerDay      float32 `json:"max_per_day"`       // 1000.000
+	MaxCountPerDay int     `json:"max_count_per_day"` // 10
+}
+
+type TransferUsage struct {
+	UserId string  `json:"user_id"` // "1725"
+	Date   string  `json:"date"`    // "20180701"
+	Amount float32 `json:"amount"`  // 300.000
+	Count  int     `json:"count"`   // 2
+}
+
+type TransferLimitResult struct {
+	Status    Status        `json:"status"`
+	Limit     TransferLimit `json:"limit"`
+	IsDefault bool          `json:"is_default"`
+	Usage     TransferUsage `json:"usage"`
+}
+
+// ユーザー毎のTransferLimit用Stateキー作成関数
+func (s *SmartContract) makeTransferLimitKey(userId string) string {
+	return "transfer_limit_" + userId
+}
+
+// デフォルトのTransferLimit用Stateキー作成関数
+func (s *SmartContract) makeDefaultTransferLimitKey() string {
+	return "default_transfer_limit"
+}
+
+// TransferUsage用Stateキー作成関数
+func (s *SmartContract) makeTransferUsageKey(userId string, date string) string {
+	return "transfer_usage_" + userId + "_" + date
+}
+
+// 指定キーの譲渡上限データ取得
+func (s *SmartContract) getTransferLimitFromState(APIstub shim.ChaincodeStubInterface, key string) (TransferLimit, bool) {
+	limitAsBytes, _ := APIstub.GetState(key)
+	limit := TransferLimit{}
+
+	if len(limitAsBytes) == 0 {
+		return limit, false
+	}
+	json.Unmarshal(limitAsBytes, &limit)
+
+	return limit, true
+}
+
+// 指定ユーザーに適用される譲渡上限を取得する
+// ユーザー毎の上限がなければデフォルトの上限を使う
+func (s *SmartContract) getEffectiveTransferLimit(APIstub shim.ChaincodeStubInterface, userId string) (TransferLimit, bool) {
+	if limit, ok := s.getTransferLimitFromState(APIstub, s.makeTransferLimitKey(userId)); ok {
+		return limit, false
+	}
+
+	limit, _ := s.getTransferLimitFromState(APIstub, s.makeDefaultTransferLimitKey())
+	return limit, true
+}
+
+// 指定ユーザーのトランザクション日の譲渡実績を取得する
+func (s *SmartContract) getTransferUsage(APIstub shim.ChaincodeStubInterface, userId string) TransferUsage {
+	date := s.getTxTime(APIstub).Format(DateFormat)
+	usageAsBytes, _ := APIstub.GetState(s.makeTransferUsageKey(userId, date))
+	usage := TransferUsage{UserId: userId, Date: date}
+
+	if len(usageAsBytes) != 0 {
+		json.Unmarshal(usageAsBytes, &usage)
+	}
+
+	return usage
+}
+
+// 指定ユーザーに1日あたりの譲渡上限が適用されるかどうか
+// 管理者の譲渡は複数承認で統制するので対象外とする
+func (s *SmartContract) hasDailyTransferLimit(APIstub shim.ChaincodeStubInterface, userId string) bool {
+	if userId == AdminUserId {
+		return false
+	}
+	limit, _ := s.getEffectiveTransferLimit(APIstub, userId)
+	return limit.MaxPerDay > 0 || limit.MaxCountPerDay > 0
+}
+
+// 譲渡実績に加算する
+// 高頻度口座は日毎の実績キーが競合の原因となるので記録しない(1日あたりの上限は適用できない)
+func (s *SmartContract) addTransferUsage(APIstub shim.ChaincodeStubInterface, userId string, total float32) {
+	// 負の値で実績を減らせないようにする
+	if !(total > 0) || s.isHotAccount(APIstub, DefaultTokenType, userId) {
+		return
+	}
+
+	usage := s.getTransferUsage(APIstub, userId)
+	usage.Amount += total
+	usage.Count++
+
+	usageAsBytes, _ := json.Marshal(usage)
+	APIstub.PutState(s.makeTransferUsageKey(userId, usage.Date), usageAsBytes)
+}
+
+// 譲渡が上限を超えないかチェックする
+// 高頻度口座は日毎の実績を記録しないので、1日あたりの上限が適用される場合は譲渡できない
+func (s *SmartContract) checkTransferLimit(APIstub shim.ChaincodeStubInterface, userId string, total float32) (Status, string) {
+	if !(total > 0) {
+		return StatusBadRequest, "譲渡額は正の値を指定してください"
+	}
+
+	limit, _ := s.getEffectiveTransferLimit(APIstub, userId)
+
+	if limit.MaxPerTransfer > 0 && total > limit.MaxPerTransfer {
+		return StatusLimitOver, fmt.Sprintf("1回あたりの譲渡上限(%.3f)を超えています", limit.MaxPerTransfer)
+	}
+	if s.isHotAccount(APIstub, DefaultTokenType, userId) {
+		if s.hasDailyTransferLimit(APIstub, userId) {
+			return StatusLimitOver, "高頻度口座には1日あたりの譲渡上限を適用できません"
+		}
+		return StatusOk, ""
+	}
+
+	usage := s.getTransferUsage(APIstub, userId)
+	if limit.MaxPerDay > 0 && usage.Amount+total > limit.MaxPerDay {
+		return StatusLimitOver, fmt.Sprintf("1日あたりの譲渡上限(%.3f)を超えています(本日の譲渡額: %.3f)", limit.MaxPerDay, usage.Amount)
+	}
+	if limit.MaxCountPerDay > 0 && usage.Count+1 > limit.MaxCountPerDay {
+		return StatusLimitOver, fmt.Sprintf("1日あたりの譲渡回数の上限(%d回)を超えています", limit.MaxCountPerDay)
+	}
+
+	return StatusOk, ""
+}
+
+// 引数から譲渡上限データを作成する
+func (s *SmartContract) parseTransferLimit(userId string, args []string) (TransferLimit, error) {
+	maxPerTransfer, err := strconv.ParseFloat(args[0], 32)
+	if err != nil || maxPerTransfer < 0 {
+		return TransferLimit{}, fmt.Errorf("Incorrect type of arguments.")
+	}
+	maxPerDay, err := strconv.ParseFloat(args[1], 32)
+	if err != nil || maxPerDay < 0 {
+		return TransferLimit{}, fmt.Errorf("Incorrect type of arguments.")
+	}
+	maxCountPerDay, err := strconv.Atoi(args[2])
+	if err != nil || maxCountPerDay < 0 {
+		return TransferLimit{}, fmt.Errorf("Incorrect type of arguments.")
+	}
+
+	limit := TransferLimit{
+		UserId:         userId,
+		MaxPerTransfer: float32(maxPerTransfer),
+		MaxPerDay:      float32(maxPerDay),
+		MaxCountPerDay: maxCountPerDay,
+	}
+	return limit, nil
+}
+
+// ユーザー毎の譲渡上限を設定する(管理者のみ)
+func (s *SmartContract) setTransferLimit(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	limit, err := s.parseTransferLimit(args[0], args[1:])
+	if err != nil || limit.UserId == "" {
+		return shim.Error("Incorrect type of arguments.")
+	}
+
+	if !s.isAdminInvoker(APIstub) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "管理者のみ実行できます")
+	}
+	if (limit.MaxPerDay > 0 || limit.MaxCountPerDay > 0) && s.isHotAccount(APIstub, DefaultTokenType, limit.UserId) {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "高頻度口座には1日あたりの譲渡上限を設定できません")
+	}
+
+	limitAsBytes, _ := json.Marshal(limit)
+	APIstub.PutState(s.makeTransferLimitKey(limit.UserId), limitAsBytes)
+
+	result := TransferLimitResult{Status: StatusOk, Limit: limit, IsDefault: false, Usage: s.getTransferUsage(APIstub, limit.UserId)}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// ユーザー毎の上限がない場合に適用される譲渡上限を設定する(管理者のみ)
+func (s *SmartContract) setDefaultTransferLimit(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	limit, err := s.parseTransferLimit("", args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if !s.isAdminInvoker(APIstub) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "管理者のみ実行できます")
+	}
+
+	limitAsBytes, _ := json.Marshal(limit)
+	APIstub.PutState(s.makeDefaultTransferLimitKey(), limitAsBytes)
+
+	result := TransferLimitResult{Status: StatusOk, Limit: limit, IsDefault: true}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 指定ユーザーに適用される譲渡上限と本日の譲渡実績を取得する
+func (s *SmartContract) getTransferLimit(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	userId := args[0]
+	limit, isDefault := s.getEffectiveTransferLimit(APIstub, userId)
+
+	result := TransferLimitResult{Status: StatusOk, Limit: limit, IsDefault: isDefault, Usage: s.getTransferUsage(APIstub, userId)}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
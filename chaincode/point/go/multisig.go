@@ -0,0 +1,463 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+type ProposalKind string
+
+const (
+	ProposalKindIssue    ProposalKind = "issue"
+	ProposalKindTransfer ProposalKind = "transfer"
+)
+
+type ProposalStatus string
+
+const (
+	ProposalStatusPending  ProposalStatus = "pending"
+	ProposalStatusExecuted ProposalStatus = "executed"
+	ProposalStatusFailed   ProposalStatus = "failed"
+	ProposalStatusExpired  ProposalStatus = "expired"
+)
+
+const pendingProposalIndexName = "proposal~pending"
+
+// 有効期限の指定がない場合の提案の有効期間
+const DefaultProposalDuration = 72 * time.Hour
+
+// Thresholdが0の場合は承認不要とする
+type ApprovalPolicy struct {
+	Threshold   int      `json:"threshold"`    // 2
+	LargeAmount float32  `json:"large_amount"` // 10000.000 (この額以上は承認が必要)
+	ApproverIds []string `json:"approver_ids"` // ["officer1", "officer2", "officer3"]
+}
+
+type Proposal struct {
+	ProposalId     string         `json:"proposal_id"`     // "e3b0c442..."(提案時のTxID)
+	Kind           ProposalKind   `json:"kind"`            // "transfer"
+	FromUserId     string         `json:"from_user_id"`    // "admin"
+	ToUserId       string         `json:"to_user_id"`      // "1725"
+	Point          float32        `json:"price"`           // 50000.000
+	ProposerId     string         `json:"proposer_id"`     // "officer1"
+	Approvals      []string       `json:"approvals"`       // ["officer1"]
+	Threshold      int            `json:"threshold"`       // 2
+	ProposalStatus ProposalStatus `json:"proposal_status"` // "pending"
+	Message        string         `json:"message"`         // 実行に失敗した場合の理由
+	ExecutedTxId   string         `json:"executed_tx_id"`  // "a1b2c3d4..."
+	CreatedAt      string         `json:"created_at"`      // "2018-07-01 20:32:11 UTC"
+	ExpiresAt      string         `json:"expires_at"`      // "2018-07-04 20:32:11 UTC"
+}
+
+type ApprovalPolicyResult struct {
+	Status Status         `json:"status"`
+	Policy ApprovalPolicy `json:"policy"`
+}
+
+type ProposalResult struct {
+	Status   Status   `json:"status"`
+	Proposal Proposal `json:"proposal"`
+}
+
+type GetPendingProposalsResult struct {
+	Status    Status     `json:"status"`
+	Proposals []Proposal `json:"proposals"`
+}
+
+// ApprovalPolicy用Stateキー作成関数
+func (s *SmartContract) makeApprovalPolicyKey() string {
+	return "approval_policy"
+}
+
+// 日毎の承認なしの発行実績用Stateキー作成関数
+func (s *SmartContract) makeIssuanceUsageKey(date string) string {
+	return "issuance_usage_" + date
+}
+
+// Proposal用Stateキー作成関数
+func (s *SmartContract) makeProposalKey(proposalId string) string {
+	return "proposal_" + proposalId
+}
+
+// 承認ポリシーの取得
+func (s *SmartContract) getApprovalPolicyFromState(APIstub shim.ChaincodeStubInterface) ApprovalPolicy {
+	policyAsBytes, _ := APIstub.GetState(s.makeApprovalPolicyKey())
+	policy := ApprovalPolicy{}
+
+	if len(policyAsBytes) != 0 {
+		json.Unmarshal(policyAsBytes, &policy)
+	}
+
+	return policy
+}
+
+// 指定額の発行・譲渡に複数承認が必要かどうか
+func (s *SmartContract) requiresApproval(APIstub shim.ChaincodeStubInterface, point float32) bool {
+	policy := s.getApprovalPolicyFromState(APIstub)
+	return policy.Threshold > 0 && point >= policy.LargeAmount
+}
+
+// 承認なしの発行実績(当日分)の取得
+func (s *SmartContract) getIssuanceUsage(APIstub shim.ChaincodeStubInterface) float32 {
+	usageAsBytes, _ := APIstub.GetState(s.makeIssuanceUsageKey(s.getTxTime(APIstub).Format(DateFormat)))
+	usage := float32(0)
+
+	if len(usageAsBytes) != 0 {
+		json.Unmarshal(usageAsBytes, &usage)
+	}
+
+	return usage
+}
+
+// 承認なしの発行に複数承認が必要かどうか
+// 少額の発行を繰り返して承認を回避できないよう、当日の承認なしの発行の合計で判定する
+func (s *SmartContract) requiresIssuanceApproval(APIstub shim.ChaincodeStubInterface, point float32) bool {
+	policy := s.getApprovalPolicyFromState(APIstub)
+	if policy.Threshold < 1 {
+		return false
+	}
+	return s.getIssuanceUsage(APIstub)+point >= policy.LargeAmount
+}
+
+// 承認なしの発行実績に加算する
+// 承認ポリシーがない場合は実績キーが発行同士の競合の原因となるので記録しない
+func (s *SmartContract) addIssuanceUsage(APIstub shim.ChaincodeStubInterface, point float32) {
+	if s.getApprovalPolicyFromState(APIstub).Threshold < 1 {
+		return
+	}
+
+	usageAsBytes, _ := json.Marshal(s.getIssuanceUsage(APIstub) + point)
+	APIstub.PutState(s.makeIssuanceUsageKey(s.getTxTime(APIstub).Format(DateFormat)), usageAsBytes)
+}
+
+// 管理者の残高からの出金に複数承認が必要かチェックする
+// 譲渡・仮押さえ・委任による譲渡・請求の支払い・キャンペーンの付与など、管理者の残高を減らす処理はすべてここを通すこと
+func (s *SmartContract) checkAdminDebit(APIstub shim.ChaincodeStubInterface, tokenType string, fromUserId string, total float32) (Status, string) {
+	if fromUserId != AdminUserId || !s.isDefaultTokenType(tokenType) || !s.requiresApproval(APIstub, total) {
+		return StatusOk, ""
+	}
+	return StatusNotAllowed, "管理者からの高額の譲渡はproposeTransferで承認を得てください"
+}
+
+// 指定ユーザーが承認者かどうか
+func (s *SmartContract) isApprover(policy ApprovalPolicy, userId string) bool {
+	for _, approverId := range policy.ApproverIds {
+		if approverId == userId {
+			return true
+		}
+	}
+	return false
+}
+
+// 指定IDの提案取得
+// 期限切れの承認待ちの提案は期限切れとして返す
+func (s *SmartContract) getProposalFromState(APIstub shim.ChaincodeStubInterface, proposalId string) Proposal {
+	proposalAsBytes, _ := APIstub.GetState(s.makeProposalKey(proposalId))
+	proposal := Proposal{}
+
+	if len(proposalAsBytes) != 0 {
+		json.Unmarshal(proposalAsBytes, &proposal)
+	}
+
+	if proposal.ProposalStatus == ProposalStatusPending {
+		expiresAt, err := time.Parse(DateTimeFormat, proposal.ExpiresAt)
+		if err == nil && !s.getTxTime(APIstub).Before(expiresAt) {
+			proposal.ProposalStatus = ProposalStatusExpired
+		}
+	}
+
+	return proposal
+}
+
+// 提案データput
+// 承認待ちのものだけインデックスに載せる
+func (s *SmartContract) putProposal(APIstub shim.ChaincodeStubInterface, proposal Proposal) {
+	proposalAsBytes, _ := json.Marshal(proposal)
+	APIstub.PutState(s.makeProposalKey(proposal.ProposalId), proposalAsBytes)
+
+	indexKey, _ := APIstub.CreateCompositeKey(pendingProposalIndexName, []string{proposal.ProposalId})
+	if proposal.ProposalStatus == ProposalStatusPending {
+		APIstub.PutState(indexKey, []byte{0x00})
+	} else {
+		APIstub.DelState(indexKey)
+	}
+}
+
+// 提案を実行する
+func (s *SmartContract) executeProposal(APIstub shim.ChaincodeStubInterface, proposal Proposal) Proposal {
+	switch proposal.Kind {
+	case ProposalKindIssue:
+		s.applyIssuance(APIstub, proposal.Point)
+	case ProposalKindTransfer:
+		_, _, status, message := s.tryApprovedTransfer(APIstub, DefaultTokenType, proposal.FromUserId, proposal.ToUserId, proposal.Point)
+		if status != StatusOk {
+			proposal.ProposalStatus = ProposalStatusFailed
+			proposal.Message = message
+			return proposal
+		}
+	}
+
+	proposal.ProposalStatus = ProposalStatusExecuted
+	proposal.ExecutedTxId = APIstub.GetTxID()
+	return proposal
+}
+
+// 提案を作成する(承認者のみ)
+// 提案者の承認は作成時に記録する
+func (s *SmartContract) createProposal(APIstub shim.ChaincodeStubInterface, proposal Proposal, expiry string) sc.Response {
+	policy := s.getApprovalPolicyFromState(APIstub)
+	proposerId := s.getInvokerId(APIstub)
+
+	if policy.Threshold < 1 {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "承認ポリシーが設定されていません")
+	}
+	if !s.isApprover(policy, proposerId) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "承認者のみ提案できます")
+	}
+
+	now := s.getTxTime(APIstub)
+	expiresAt := now.Add(DefaultProposalDuration)
+	if expiry != "" {
+		var err error
+		expiresAt, err = time.Parse(DateTimeFormat, expiry)
+		if err != nil {
+			return shim.Error("Incorrect type of arguments.")
+		}
+	}
+	if !expiresAt.After(now) {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "有効期限が過去の日時です")
+	}
+
+	proposal.ProposalId = APIstub.GetTxID()
+	proposal.ProposerId = proposerId
+	proposal.Approvals = []string{proposerId}
+	proposal.Threshold = policy.Threshold
+	proposal.ProposalStatus = ProposalStatusPending
+	proposal.CreatedAt = now.Format(DateTimeFormat)
+	proposal.ExpiresAt = expiresAt.UTC().Format(DateTimeFormat)
+
+	// 承認者が1人でよい場合はそのまま実行
+	if len(proposal.Approvals) >= proposal.Threshold {
+		proposal = s.executeProposal(APIstub, proposal)
+	}
+	s.putProposal(APIstub, proposal)
+
+	result := ProposalResult{Status: StatusOk, Proposal: proposal}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 承認ポリシーを設定する(管理者のみ)
+// 3つ目以降の引数に承認者を列挙する
+func (s *SmartContract) setApprovalPolicy(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) < 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or more")
+	}
+
+	threshold, err := strconv.Atoi(args[0])
+	if err != nil || threshold < 0 {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	largeAmount, err := strconv.ParseFloat(args[1], 32)
+	if err != nil || largeAmount < 0 {
+		return shim.Error("Incorrect type of arguments.")
+	}
+
+	if !s.isAdminInvoker(APIstub) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "管理者のみ実行できます")
+	}
+
+	policy := ApprovalPolicy{
+		Threshold:   threshold,
+		LargeAmount: float32(largeAmount),
+		ApproverIds: []string{},
+	}
+	for _, approverId := range args[2:] {
+		if approverId != "" && !s.isApprover(policy, approverId) {
+			policy.ApproverIds = append(policy.ApproverIds, approverId)
+		}
+	}
+	if threshold > len(policy.ApproverIds) {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "承認者数が必要承認数より少ないです")
+	}
+
+	policyAsBytes, _ := json.Marshal(policy)
+	APIstub.PutState(s.makeApprovalPolicyKey(), policyAsBytes)
+
+	result := ApprovalPolicyResult{Status: StatusOk, Policy: policy}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+func (s *SmartContract) getApprovalPolicy(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	result := ApprovalPolicyResult{Status: StatusOk, Policy: s.getApprovalPolicyFromState(APIstub)}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 管理者の残高への発行を提案する
+func (s *SmartContract) proposeIssuance(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+
+	val, err := strconv.ParseFloat(args[0], 32)
+	if err != nil || val <= 0 {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	expiry := ""
+	if len(args) == 2 {
+		expiry = args[1]
+	}
+
+	proposal := Proposal{
+		Kind:       ProposalKindIssue,
+		FromUserId: AdminUserId,
+		ToUserId:   AdminUserId,
+		Point:      float32(val),
+	}
+	return s.createProposal(APIstub, proposal, expiry)
+}
+
+// 管理者の残高からの譲渡を提案する
+// 承認者が任意の口座から出金できないよう、譲渡元は管理者のみ指定できる
+func (s *SmartContract) proposeTransfer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4")
+	}
+
+	val, err := strconv.ParseFloat(args[2], 32)
+	if err != nil || val <= 0 {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	expiry := ""
+	if len(args) == 4 {
+		expiry = args[3]
+	}
+	if args[0] != AdminUserId {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "管理者の残高からの譲渡のみ提案できます")
+	}
+
+	proposal := Proposal{
+		Kind:       ProposalKindTransfer,
+		FromUserId: args[0],
+		ToUserId:   args[1],
+		Point:      float32(val),
+	}
+	return s.createProposal(APIstub, proposal, expiry)
+}
+
+// 提案を承認する(承認者のみ)
+// 必要承認数に達した時点で実行する
+func (s *SmartContract) approveProposal(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	approverId := s.getInvokerId(APIstub)
+
+	proposal := s.getProposalFromState(APIstub, args[0])
+	if proposal.ProposalId == "" {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "提案が見つかりませんでした")
+	}
+	if proposal.ProposalStatus == ProposalStatusExpired {
+		// 期限切れを記録して承認待ちの一覧から外す
+		s.putProposal(APIstub, proposal)
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "提案の有効期限が切れています")
+	}
+	if proposal.ProposalStatus != ProposalStatusPending {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "承認待ちの提案ではありません")
+	}
+	if !s.isApprover(s.getApprovalPolicyFromState(APIstub), approverId) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "承認者のみ承認できます")
+	}
+	for _, approvedId := range proposal.Approvals {
+		if approvedId == approverId {
+			return s.makeErrorResponce(APIstub, StatusBadRequest, "すでに承認済みです")
+		}
+	}
+
+	proposal.Approvals = append(proposal.Approvals, approverId)
+	if len(proposal.Approvals) >= proposal.Threshold {
+		proposal = s.executeProposal(APIstub, proposal)
+	}
+	s.putProposal(APIstub, proposal)
+
+	result := ProposalResult{Status: StatusOk, Proposal: proposal}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+func (s *SmartContract) getPendingProposals(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	indexIterator, err := APIstub.GetStateByPartialCompositeKey(pendingProposalIndexName, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer indexIterator.Close()
+
+	var proposals []Proposal
+	for indexIterator.HasNext() {
+		queryResponse, err := indexIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, keyParts, err := APIstub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(keyParts) != 1 {
+			continue
+		}
+		proposal := s.getProposalFromState(APIstub, keyParts[0])
+		if proposal.ProposalStatus != ProposalStatusPending {
+			continue
+		}
+		proposals = append(proposals, proposal)
+	}
+
+	result := GetPendingProposalsResult{Status: StatusOk, Proposals: proposals}
+	if len(proposals) < 1 {
+		result.Status = StatusNotFound
+	}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
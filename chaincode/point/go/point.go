@@ -21,28 +21,44 @@ package main
 
 import (
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"math"
 	"strconv"
 	"time"
+	"unicode/utf8"
 
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	sc "github.com/hyperledger/fabric/protos/peer"
 )
 
 type Balance struct {
-	UserId string  `json:"user_id"` // "1725"
-	Amount float32 `json:"amount"`  // 2000.000
-	Total  float32 `json:"total"`   // 2500.000
+	UserId    string  `json:"user_id"`              // "1725"
+	TokenType string  `json:"token_type,omitempty"` // "thanks"(デフォルトのポイントは空)
+	Amount    float32 `json:"amount"`               // 2000.000 (利用可能な残高)
+	Held      float32 `json:"held"`                 // 300.000 (仮押さえ中の残高)
+	Total     float32 `json:"total"`                // 2500.000
+
+	AccountStatus AccountStatus `json:"account_status"`      // "active"
+	BlockIncoming bool          `json:"block_incoming"`      // 凍結中に入金も止めるか
+	ClosedTo      string        `json:"closed_to,omitempty"` // 解約時の残高の移動先
+
+	PeriodMonth string `json:"period_month,omitempty"` // "201808" (最後に更新した月)
 }
 
 type TransferHistory struct {
-	ToUserId   string  `json:"to_user_id"`   // "1725"
-	FromUserId string  `json:"from_user_id"` // "0001"
-	Point      float32 `json:"price"`        // 300.000
+	TokenType  string  `json:"token_type,omitempty"` // "thanks"(デフォルトのポイントは空)
+	ToUserId   string  `json:"to_user_id"`           // "1725"
+	FromUserId string  `json:"from_user_id"`         // "0001"
+	Point      float32 `json:"price"`                // 300.000 (手数料込みの増減)
+	Fee        float32 `json:"fee,omitempty"`        // 0.000
+	RefundOf   string  `json:"refund_of,omitempty"`  // 返金元の取引のTxID
 }
 
 type TransferHistoryWithTimestamp struct {
 	TransferHistory
+	TxId      string `json:"tx_id"`      // "e3b0c442..."
 	CreatedAt string `json:"created_at"` // "2018-07-01 20:32:11 UTC"
 }
 
@@ -52,6 +68,8 @@ const (
 	StatusOk         Status = 200
 	StatusBadRequest Status = 400
 	StatusNotFound   Status = 404
+	StatusNotAllowed Status = 405
+	StatusLimitOver  Status = 429
 )
 
 const MonthFormat = "200601"
@@ -62,6 +80,7 @@ const AdminUserId string = "admin"
 type GetBalanceResult struct {
 	Status  Status  `json:"status"`
 	Balance Balance `json:"balance"`
+	Holds   []Hold  `json:"holds"`
 }
 
 type GetHistoryResult struct {
@@ -76,8 +95,8 @@ type TransferResult struct {
 }
 
 type IssueNewPointResult struct {
-	Status       Status  `json:"status"`
-	AdminBalance Balance `json:"admin_balance"`
+	Status      Status  `json:"status"`
+	IssuedPoint float32 `json:"issued_point"`
 }
 
 type ErrorResult struct {
@@ -90,6 +109,10 @@ type SmartContract struct {
 }
 
 func (s *SmartContract) Init(APIstub shim.ChaincodeStubInterface) sc.Response {
+	s.initDefaultTokenType(APIstub)
+	if err := s.initGenesisIssuance(APIstub); err != nil {
+		return shim.Error(err.Error())
+	}
 	return s.initAdmin(APIstub)
 }
 
@@ -104,12 +127,144 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 	if function == "getHistory" {
 		return s.getHistory(APIstub, args)
 	}
+	if function == "getStatement" {
+		return s.getStatement(APIstub, args)
+	}
 	if function == "transfer" {
 		return s.transfer(APIstub, args)
 	}
 	if function == "issueNewPoint" {
 		return s.issueNewPoint(APIstub, args)
 	}
+	if function == "createHold" {
+		return s.createHold(APIstub, args)
+	}
+	if function == "captureHold" {
+		return s.captureHold(APIstub, args)
+	}
+	if function == "releaseHold" {
+		return s.releaseHold(APIstub, args)
+	}
+	if function == "refund" {
+		return s.refund(APIstub, args)
+	}
+	if function == "getTransfer" {
+		return s.getTransfer(APIstub, args)
+	}
+	if function == "freezeAccount" {
+		return s.freezeAccount(APIstub, args)
+	}
+	if function == "unfreezeAccount" {
+		return s.unfreezeAccount(APIstub, args)
+	}
+	if function == "closeAccount" {
+		return s.closeAccount(APIstub, args)
+	}
+	if function == "registerTokenType" {
+		return s.registerTokenType(APIstub, args)
+	}
+	if function == "listTokenTypes" {
+		return s.listTokenTypes(APIstub, args)
+	}
+	if function == "getTokenBalance" {
+		return s.getTokenBalance(APIstub, args)
+	}
+	if function == "getTokenHistory" {
+		return s.getTokenHistory(APIstub, args)
+	}
+	if function == "transferToken" {
+		return s.transferToken(APIstub, args)
+	}
+	if function == "issueToken" {
+		return s.issueToken(APIstub, args)
+	}
+	if function == "auditLedger" {
+		return s.auditLedger(APIstub, args)
+	}
+	if function == "getAuditReport" {
+		return s.getAuditReport(APIstub, args)
+	}
+	if function == "setTransferLimit" {
+		return s.setTransferLimit(APIstub, args)
+	}
+	if function == "setDefaultTransferLimit" {
+		return s.setDefaultTransferLimit(APIstub, args)
+	}
+	if function == "getTransferLimit" {
+		return s.getTransferLimit(APIstub, args)
+	}
+	if function == "createInvoice" {
+		return s.createInvoice(APIstub, args)
+	}
+	if function == "payInvoice" {
+		return s.payInvoice(APIstub, args)
+	}
+	if function == "cancelInvoice" {
+		return s.cancelInvoice(APIstub, args)
+	}
+	if function == "getInvoice" {
+		return s.getInvoice(APIstub, args)
+	}
+	if function == "getMerchantInvoices" {
+		return s.getMerchantInvoices(APIstub, args)
+	}
+	if function == "compactBalance" {
+		return s.compactBalance(APIstub, args)
+	}
+	if function == "setHotAccount" {
+		return s.setHotAccount(APIstub, args)
+	}
+	if function == "setApprovalPolicy" {
+		return s.setApprovalPolicy(APIstub, args)
+	}
+	if function == "getApprovalPolicy" {
+		return s.getApprovalPolicy(APIstub, args)
+	}
+	if function == "proposeIssuance" {
+		return s.proposeIssuance(APIstub, args)
+	}
+	if function == "proposeTransfer" {
+		return s.proposeTransfer(APIstub, args)
+	}
+	if function == "approveProposal" {
+		return s.approveProposal(APIstub, args)
+	}
+	if function == "getPendingProposals" {
+		return s.getPendingProposals(APIstub, args)
+	}
+	if function == "snapshotBalances" {
+		return s.snapshotBalances(APIstub, args)
+	}
+	if function == "getBalanceAt" {
+		return s.getBalanceAt(APIstub, args)
+	}
+	if function == "getSnapshotSummary" {
+		return s.getSnapshotSummary(APIstub, args)
+	}
+	if function == "createCampaign" {
+		return s.createCampaign(APIstub, args)
+	}
+	if function == "endCampaign" {
+		return s.endCampaign(APIstub, args)
+	}
+	if function == "getCampaign" {
+		return s.getCampaign(APIstub, args)
+	}
+	if function == "applyCampaign" {
+		return s.applyCampaign(APIstub, args)
+	}
+	if function == "approve" {
+		return s.approve(APIstub, args)
+	}
+	if function == "transferFrom" {
+		return s.transferFrom(APIstub, args)
+	}
+	if function == "revokeApproval" {
+		return s.revokeApproval(APIstub, args)
+	}
+	if function == "getAllowance" {
+		return s.getAllowance(APIstub, args)
+	}
 
 	return shim.Error("Invalid Smart Contract function name.")
 }
@@ -119,21 +274,83 @@ func (s *SmartContract) makeBalanceKey(userId string) string {
 	return "balance_" + userId
 }
 
+// ポイント種別毎のBalance用Stateキー作成関数
+// デフォルトのポイントは従来のキーを使い、それ以外はユーザーIDと区別できるよう複合キーとする
+func (s *SmartContract) makeTokenBalanceKey(APIstub shim.ChaincodeStubInterface, tokenType string, userId string) string {
+	if s.isDefaultTokenType(tokenType) {
+		return s.makeBalanceKey(userId)
+	}
+	key, _ := APIstub.CreateCompositeKey(tokenBalanceIndexName, []string{tokenType, userId})
+	return key
+}
+
 // TransferBill用Stateキー作成関数
 func (s *SmartContract) makeTransferBillKey(userId string, month string) string {
 	return "transfer_bill_" + userId + "_" + month
 }
 
+// ポイント種別毎のTransferBill用Stateキー作成関数
+// デフォルトのポイントは従来のキーを使い、それ以外は複合キーとする
+func (s *SmartContract) makeTokenTransferBillKey(APIstub shim.ChaincodeStubInterface, tokenType string, userId string, month string) string {
+	if s.isDefaultTokenType(tokenType) {
+		return s.makeTransferBillKey(userId, month)
+	}
+	key, _ := APIstub.CreateCompositeKey(tokenTransferBillIndexName, []string{tokenType, userId, month})
+	return key
+}
+
 // 残高が空のBalance構造体作成
 func (s *SmartContract) makeEmptyBalance(userId string) Balance {
+	return s.makeEmptyTokenBalance(DefaultTokenType, userId)
+}
+
+// 指定ポイント種別の残高が空のBalance構造体作成
+func (s *SmartContract) makeEmptyTokenBalance(tokenType string, userId string) Balance {
 	result := Balance{
-		UserId: userId,
-		Amount: 0.0,
-		Total:  0.0,
+		UserId:        userId,
+		Amount:        0.0,
+		Held:          0.0,
+		Total:         0.0,
+		AccountStatus: AccountStatusActive,
+	}
+	if !s.isDefaultTokenType(tokenType) {
+		result.TokenType = tokenType
 	}
 	return result
 }
 
+// 呼び出し元のFabricアイデンティティ(証明書のCN)を取得する
+func (s *SmartContract) getInvokerId(APIstub shim.ChaincodeStubInterface) string {
+	cert, err := cid.GetX509Certificate(APIstub)
+	if err != nil || cert == nil {
+		return ""
+	}
+	return cert.Subject.CommonName
+}
+
+// 呼び出し元の証明書をPEM形式で取得する
+func (s *SmartContract) getInvokerCertPem(APIstub shim.ChaincodeStubInterface) string {
+	cert, err := cid.GetX509Certificate(APIstub)
+	if err != nil || cert == nil {
+		return ""
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+}
+
+// 呼び出し元が管理者かどうか
+func (s *SmartContract) isAdminInvoker(APIstub shim.ChaincodeStubInterface) bool {
+	return s.getInvokerId(APIstub) == AdminUserId
+}
+
+// トランザクションのタイムスタンプを取得する
+func (s *SmartContract) getTxTime(APIstub shim.ChaincodeStubInterface) time.Time {
+	txTimestamp, err := APIstub.GetTxTimestamp()
+	if err != nil {
+		return time.Now().UTC()
+	}
+	return time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()
+}
+
 // エラーレスポンスを生成する
 func (s *SmartContract) makeErrorResponce(APIstub shim.ChaincodeStubInterface, code Status, message string) sc.Response {
 	result := ErrorResult{
@@ -148,7 +365,12 @@ func (s *SmartContract) makeErrorResponce(APIstub shim.ChaincodeStubInterface, c
 
 // 指定ユーザーの残高取得
 func (s *SmartContract) getUserBalance(APIstub shim.ChaincodeStubInterface, userId string) Balance {
-	key := s.makeBalanceKey(userId)
+	return s.getUserTokenBalance(APIstub, DefaultTokenType, userId)
+}
+
+// 指定ユーザーの指定ポイント種別の残高取得
+func (s *SmartContract) getUserTokenBalance(APIstub shim.ChaincodeStubInterface, tokenType string, userId string) Balance {
+	key := s.makeTokenBalanceKey(APIstub, tokenType, userId)
 
 	balanceAsBytes, _ := APIstub.GetState(key)
 	balance := new(Balance)
@@ -160,28 +382,84 @@ func (s *SmartContract) getUserBalance(APIstub shim.ChaincodeStubInterface, user
 	return *balance
 }
 
+// Stateキーが残高データのユーザーID・ポイント種別に対応するものか判別する
+func (s *SmartContract) isBalanceKeyOf(APIstub shim.ChaincodeStubInterface, key string, balance Balance) bool {
+	return key == s.makeTokenBalanceKey(APIstub, balance.TokenType, balance.UserId)
+}
+
+// 全口座の残高データを走査する
+// デフォルトのポイント、ポイント種別毎の複合キーのデータの順に渡す
+func (s *SmartContract) scanBalances(APIstub shim.ChaincodeStubInterface, fn func(key string, value []byte)) error {
+	balanceIterator, err := APIstub.GetStateByRange(s.makeBalanceKey(""), s.makeBalanceKey(string(utf8.MaxRune)))
+	if err != nil {
+		return err
+	}
+	defer balanceIterator.Close()
+
+	for balanceIterator.HasNext() {
+		queryResponse, err := balanceIterator.Next()
+		if err != nil {
+			return err
+		}
+		fn(queryResponse.Key, queryResponse.Value)
+	}
+
+	tokenIterator, err := APIstub.GetStateByPartialCompositeKey(tokenBalanceIndexName, []string{})
+	if err != nil {
+		return err
+	}
+	defer tokenIterator.Close()
+
+	for tokenIterator.HasNext() {
+		queryResponse, err := tokenIterator.Next()
+		if err != nil {
+			return err
+		}
+		fn(queryResponse.Key, queryResponse.Value)
+	}
+
+	return nil
+}
+
 // 指定残高データが有効であるか判別する
 func (s *SmartContract) isValidBalance(balance Balance) bool {
 	if balance.UserId == "" {
 		return false
 	}
 
-	// 論理削除や有効期限など追加した場合はここでチェックする
+	// 凍結・解約の状態はcheckOutgoing/checkIncomingでチェックする
+	// 有効期限など追加した場合はここでチェックする
 
 	return true
 }
 
 // Balanceデータput
+// 月が変わって最初の更新では月初時点の残高を記録しておく(月末のスナップショットで使う)
 func (s *SmartContract) putBalance(APIstub shim.ChaincodeStubInterface, balance Balance) {
-	key := s.makeBalanceKey(balance.UserId)
+	month := s.getTxTime(APIstub).Format(MonthFormat)
+	if balance.PeriodMonth != month {
+		stored := s.getUserTokenBalance(APIstub, balance.TokenType, balance.UserId)
+		if stored.PeriodMonth != month {
+			opening := BalanceOpening{Month: month, Amount: stored.Amount + stored.Held}
+			s.putBalanceOpening(APIstub, balance.TokenType, balance.UserId, BalanceOpeningBase, opening)
+		}
+		balance.PeriodMonth = month
+	}
+
+	key := s.makeTokenBalanceKey(APIstub, balance.TokenType, balance.UserId)
 	balanceAsBytes, _ := json.Marshal(balance)
 	APIstub.PutState(key, balanceAsBytes)
 }
 
 // 取引明細データput
+// 高頻度口座はトランザクション毎のキーに記録する
 func (s *SmartContract) putTransferBill(APIstub shim.ChaincodeStubInterface, userId string, history TransferHistory) {
-	month := time.Now().Format(MonthFormat)
-	key := s.makeTransferBillKey(userId, month)
+	month := s.getTxTime(APIstub).Format(MonthFormat)
+	if s.isHotAccount(APIstub, history.TokenType, userId) {
+		s.putTransferBillDelta(APIstub, userId, month, history)
+		return
+	}
+	key := s.makeTokenTransferBillKey(APIstub, history.TokenType, userId, month)
 	historyAsBytes, _ := json.Marshal(history)
 	APIstub.PutState(key, historyAsBytes)
 }
@@ -212,12 +490,20 @@ func (s *SmartContract) getBalance(APIstub shim.ChaincodeStubInterface, args []s
 		return shim.Error("Incorrect number of arguments. Expecting 1")
 	}
 
-	key := s.makeBalanceKey(args[0])
-	balanceAsBytes, _ := APIstub.GetState(key)
-	balance := Balance{}
-	json.Unmarshal(balanceAsBytes, &balance)
+	balance := s.getUserBalance(APIstub, args[0])
+	// 期限切れの仮押さえを解放した上で返却する
+	balance = s.releaseExpiredHolds(APIstub, balance)
+	// 高頻度口座は未集約の差分を含めて返却する
+	balance = s.addPendingDeltas(APIstub, balance)
 
-	result := GetBalanceResult{Status: StatusOk, Balance: balance}
+	holds := []Hold{}
+	for _, hold := range s.getActiveHolds(APIstub, balance.UserId) {
+		if !s.isExpiredHold(APIstub, hold) {
+			holds = append(holds, hold)
+		}
+	}
+
+	result := GetBalanceResult{Status: StatusOk, Balance: balance, Holds: holds}
 	if balance.UserId == "" {
 		result.Status = StatusNotFound
 	}
@@ -226,19 +512,35 @@ func (s *SmartContract) getBalance(APIstub shim.ChaincodeStubInterface, args []s
 	return shim.Success(resultAsBytes)
 }
 
-func (s *SmartContract) getHistory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+// 指定ポイント種別・指定ユーザー・指定月の取引明細を取得する
+func (s *SmartContract) getTransferHistories(APIstub shim.ChaincodeStubInterface, tokenType string, userId string, yearMonth string) ([]TransferHistoryWithTimestamp, error) {
+	// 月は固定長とし、ユーザーIDと組み合わせたキーが別ユーザーのものと重ならないようにする
+	if _, err := time.Parse(MonthFormat, yearMonth); err != nil || len(yearMonth) != len(MonthFormat) {
+		return nil, fmt.Errorf("Incorrect type of arguments.")
+	}
 
-	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	transferHistories, err := s.getTransferBillHistories(APIstub, s.makeTokenTransferBillKey(APIstub, tokenType, userId, yearMonth))
+	if err != nil {
+		return nil, err
 	}
 
-	userId := args[0]
-	yearMonth := args[1]
-	key := s.makeTransferBillKey(userId, yearMonth)
+	// 高頻度口座の間にトランザクション毎に記録した明細も含める(設定を解除した後の分も含める)
+	if s.isDefaultTokenType(tokenType) {
+		deltaHistories, err := s.getTransferBillDeltas(APIstub, userId, yearMonth)
+		if err != nil {
+			return nil, err
+		}
+		transferHistories = append(transferHistories, deltaHistories...)
+	}
 
+	return transferHistories, nil
+}
+
+// 指定キーの取引明細の更新履歴を取得する
+func (s *SmartContract) getTransferBillHistories(APIstub shim.ChaincodeStubInterface, key string) ([]TransferHistoryWithTimestamp, error) {
 	historyIterator, err := APIstub.GetHistoryForKey(key)
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
 	defer historyIterator.Close()
 
@@ -246,84 +548,125 @@ func (s *SmartContract) getHistory(APIstub shim.ChaincodeStubInterface, args []s
 	for historyIterator.HasNext() {
 		queryResponse, err := historyIterator.Next()
 		if err != nil {
-			return shim.Error(err.Error())
+			return nil, err
 		}
 		transferHistory := TransferHistory{}
 		json.Unmarshal(queryResponse.Value, &transferHistory)
-		transferHistoryWithTimestamp := TransferHistoryWithTimestamp{transferHistory, time.Unix(queryResponse.Timestamp.Seconds, 0).Format(DateTimeFormat)}
+		createdAt := time.Unix(queryResponse.Timestamp.Seconds, 0).UTC().Format(DateTimeFormat)
+		transferHistoryWithTimestamp := TransferHistoryWithTimestamp{transferHistory, queryResponse.TxId, createdAt}
 		transferHistories = append(transferHistories, transferHistoryWithTimestamp)
 	}
 
-	result := GetHistoryResult{Status: StatusOk, History: transferHistories}
-	if len(transferHistories) < 1 {
-		result.Status = StatusNotFound
-	}
-	resultAsBytes, _ := json.Marshal(result)
-
-	return shim.Success(resultAsBytes)
+	return transferHistories, nil
 }
 
-func (s *SmartContract) transfer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+func (s *SmartContract) getHistory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
-	if len(args) != 3 {
-		return shim.Error("Incorrect number of arguments. Expecting 3")
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
 	}
 
-	fromUserId := args[0]
-	toUserId := args[1]
-	point, err := strconv.ParseFloat(args[2], 32)
+	transferHistories, err := s.getTransferHistories(APIstub, DefaultTokenType, args[0], args[1])
 	if err != nil {
-		return shim.Error("Incorrect type of arguments.")
+		return shim.Error(err.Error())
 	}
 
-	// 譲渡元の残高取得
-	fromBalance := s.getUserBalance(APIstub, fromUserId)
-
-	// 有効チェック
-	if !s.isValidBalance(fromBalance) {
-		return s.makeErrorResponce(APIstub, StatusNotFound, "譲渡元の残高が見つかりませんでした")
+	result := GetHistoryResult{Status: StatusOk, History: transferHistories}
+	if len(transferHistories) < 1 {
+		result.Status = StatusNotFound
 	}
+	resultAsBytes, _ := json.Marshal(result)
 
-	// 手数料など追加するならここで
-	total := float32(point)
+	return shim.Success(resultAsBytes)
+}
 
-	// 譲渡元の残高が足りているかチェック
-	if total > fromBalance.Amount {
-		return s.makeErrorResponce(APIstub, StatusBadRequest, "譲渡元の残高が足りません")
-	}
+// 残高の移動と取引明細の更新を行う
+// 譲渡元の有効チェックや残高チェックは呼び出し側で行う
+// 返金の場合はrefundOfに返金元の取引のTxIDを指定する
+func (s *SmartContract) applyTransfer(APIstub shim.ChaincodeStubInterface, fromBalance Balance, toUserId string, total float32, refundOf string) (Balance, Balance) {
+	toBalance := s.creditTransfer(APIstub, fromBalance, toUserId, total, refundOf)
+
+	// 譲渡元の残高減算
+	fromBalance = s.updateBalance(APIstub, fromBalance, -total, 0)
+
+	return fromBalance, toBalance
+}
 
+// 譲渡先の残高の増加と双方の取引明細・取引データの記録を行う
+// 譲渡元の残高の減算は呼び出し側で行う(仮押さえの確定など)
+func (s *SmartContract) creditTransfer(APIstub shim.ChaincodeStubInterface, fromBalance Balance, toUserId string, total float32, refundOf string) Balance {
 	// 譲渡先の残高取得
-	toBalance := s.getUserBalance(APIstub, toUserId)
+	toBalance := s.getUserTokenBalance(APIstub, fromBalance.TokenType, toUserId)
 	// なければ初期化
 	if !s.isValidBalance(toBalance) {
-		toBalance = s.makeEmptyBalance(toUserId)
+		toBalance = s.makeEmptyTokenBalance(fromBalance.TokenType, toUserId)
 	}
 
 	// 譲渡先の残高増加
-	toBalance.Amount += total
-	toBalance.Total += total
-	s.putBalance(APIstub, toBalance)
+	toBalance = s.updateBalance(APIstub, toBalance, total, total)
 
-	// 譲渡先の当月最新取引データ更新
+	// 譲渡元の当月最新取引データ更新
 	fromUserHistory := TransferHistory{
+		TokenType:  fromBalance.TokenType,
 		ToUserId:   toUserId,
-		FromUserId: fromUserId,
+		FromUserId: fromBalance.UserId,
 		Point:      -total,
+		RefundOf:   refundOf,
 	}
-	s.putTransferBill(APIstub, fromUserId, fromUserHistory)
+	s.putTransferBill(APIstub, fromBalance.UserId, fromUserHistory)
 
-	// 譲渡元の残高減算
-	fromBalance.Amount -= total
-	s.putBalance(APIstub, fromBalance)
-
-	// 譲渡元の当月最新取引データ更新
+	// 譲渡先の当月最新取引データ更新
 	toUserHistory := TransferHistory{
+		TokenType:  fromBalance.TokenType,
 		ToUserId:   toUserId,
-		FromUserId: fromUserId,
+		FromUserId: fromBalance.UserId,
 		Point:      total,
+		RefundOf:   refundOf,
 	}
 	s.putTransferBill(APIstub, toUserId, toUserHistory)
 
+	// 返金で参照できるよう取引データを記録
+	s.putTransferRecord(APIstub, TransferRecord{
+		TxId:       APIstub.GetTxID(),
+		TokenType:  fromBalance.TokenType,
+		FromUserId: fromBalance.UserId,
+		ToUserId:   toUserId,
+		Point:      total,
+		RefundOf:   refundOf,
+		CreatedAt:  s.getTxTime(APIstub).Format(DateTimeFormat),
+	})
+
+	return toBalance
+}
+
+func (s *SmartContract) transfer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	fromUserId := args[0]
+	toUserId := args[1]
+	point, err := strconv.ParseFloat(args[2], 32)
+	if err != nil || point <= 0 {
+		return shim.Error("Incorrect type of arguments.")
+	}
+
+	return s.executeTransfer(APIstub, DefaultTokenType, fromUserId, toUserId, float32(point))
+}
+
+// 指定ポイント種別の譲渡を行う
+func (s *SmartContract) executeTransfer(APIstub shim.ChaincodeStubInterface, tokenType string, fromUserId string, toUserId string, total float32) sc.Response {
+
+	if !(total > 0) {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "譲渡額は正の値を指定してください")
+	}
+
+	fromBalance, toBalance, status, message := s.tryTransfer(APIstub, tokenType, fromUserId, toUserId, total)
+	if status != StatusOk {
+		return s.makeErrorResponce(APIstub, status, message)
+	}
+
 	// レスポンス作成
 	result := TransferResult{
 		Status:          StatusOk,
@@ -336,6 +679,63 @@ func (s *SmartContract) transfer(APIstub shim.ChaincodeStubInterface, args []str
 	return shim.Success(resultAsBytes)
 }
 
+// 各種チェックを行った上で指定ポイント種別の譲渡を行う
+// 譲渡できない場合はStatusOk以外のステータスとメッセージを返す
+func (s *SmartContract) tryTransfer(APIstub shim.ChaincodeStubInterface, tokenType string, fromUserId string, toUserId string, total float32) (Balance, Balance, Status, string) {
+	// 管理者からの高額の譲渡は複数承認が必要
+	if status, message := s.checkAdminDebit(APIstub, tokenType, fromUserId, total); status != StatusOk {
+		return Balance{}, Balance{}, status, message
+	}
+
+	return s.tryApprovedTransfer(APIstub, tokenType, fromUserId, toUserId, total)
+}
+
+// 複数承認のチェックを除く各種チェックを行った上で指定ポイント種別の譲渡を行う
+// 承認済みの提案の実行以外ではtryTransferを使うこと
+func (s *SmartContract) tryApprovedTransfer(APIstub shim.ChaincodeStubInterface, tokenType string, fromUserId string, toUserId string, total float32) (Balance, Balance, Status, string) {
+
+	// 負の値で譲渡の向きを逆にしたり、譲渡実績を減らしたりできないようにする
+	if !(total > 0) {
+		return Balance{}, Balance{}, StatusBadRequest, "譲渡額は正の値を指定してください"
+	}
+
+	// 譲渡元の残高取得
+	fromBalance := s.getUserTokenBalance(APIstub, tokenType, fromUserId)
+
+	// 有効チェック
+	if !s.isValidBalance(fromBalance) {
+		return fromBalance, Balance{}, StatusNotFound, "譲渡元の残高が見つかりませんでした"
+	}
+	// 凍結・解約チェック(口座の状態はデフォルトのポイントの残高データで管理する)
+	if status, message := s.checkOutgoing(s.getUserBalance(APIstub, fromUserId)); status != StatusOk {
+		return fromBalance, Balance{}, status, message
+	}
+	if status, message := s.checkIncoming(s.getUserBalance(APIstub, toUserId)); status != StatusOk {
+		return fromBalance, Balance{}, status, message
+	}
+	// 期限切れの仮押さえがあれば利用可能な残高に戻す
+	fromBalance = s.releaseExpiredHolds(APIstub, fromBalance)
+
+	// 手数料など追加するならここで
+
+	// 譲渡元の残高が足りているかチェック
+	if !s.hasEnoughBalance(APIstub, fromBalance, total) {
+		return fromBalance, Balance{}, StatusBadRequest, "譲渡元の残高が足りません"
+	}
+
+	// 譲渡上限チェック(デフォルトのポイントのみ)
+	if s.isDefaultTokenType(tokenType) {
+		if status, message := s.checkTransferLimit(APIstub, fromUserId, total); status != StatusOk {
+			return fromBalance, Balance{}, status, message
+		}
+		s.addTransferUsage(APIstub, fromUserId, total)
+	}
+
+	fromBalance, toBalance := s.applyTransfer(APIstub, fromBalance, toUserId, total, "")
+
+	return fromBalance, toBalance, StatusOk, ""
+}
+
 func (s *SmartContract) issueNewPoint(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
 	if len(args) != 1 {
@@ -343,21 +743,43 @@ func (s *SmartContract) issueNewPoint(APIstub shim.ChaincodeStubInterface, args
 	}
 
 	val, err := strconv.ParseFloat(args[0], 32)
-	if err != nil {
+	if err != nil || val <= 0 || math.IsNaN(val) {
 		return shim.Error("Incorrect type of arguments.")
 	}
 	point := float32(val)
 
+	invokerId := s.getInvokerId(APIstub)
+	if invokerId == "" || invokerId != s.getTokenIssuerId(APIstub, DefaultTokenType) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "ポイントの発行者のみ実行できます")
+	}
+
+	// 高額の発行は複数承認が必要(当日の承認なしの発行の合計で判定する)
+	if s.requiresIssuanceApproval(APIstub, point) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "高額の発行はproposeIssuanceで承認を得てください")
+	}
+	s.addIssuanceUsage(APIstub, point)
+
+	// 管理者の残高は差分のみ記録され範囲読み取りを避けるため、返却値は発行額のみとする(残高はgetBalanceで参照する)
+	s.applyIssuance(APIstub, point)
+
+	result := IssueNewPointResult{Status: StatusOk, IssuedPoint: point}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 管理者の残高にポイントを発行する
+func (s *SmartContract) applyIssuance(APIstub shim.ChaincodeStubInterface, point float32) Balance {
+
 	// 管理者の残高の取得
-	adminBalanceKey := s.makeBalanceKey(AdminUserId)
-	balanceAsBytes, _ := APIstub.GetState(adminBalanceKey)
-	adminBalance := Balance{}
-	json.Unmarshal(balanceAsBytes, &adminBalance)
+	adminBalance := s.getUserBalance(APIstub, AdminUserId)
+	if !s.isValidBalance(adminBalance) {
+		adminBalance = s.makeEmptyBalance(AdminUserId)
+	}
 
 	// balanceを更新
-	adminBalance.Amount += point
-	adminBalance.Total += point
-	s.putBalance(APIstub, adminBalance)
+	// 管理者は高頻度口座なので差分のみ記録される(返却値は分割残高・未集約の差分を含まない)
+	adminBalance = s.updateBalance(APIstub, adminBalance, point, point)
 
 	// 履歴を更新
 	userHistory := TransferHistory{
@@ -367,10 +789,10 @@ func (s *SmartContract) issueNewPoint(APIstub shim.ChaincodeStubInterface, args
 	}
 	s.putTransferBill(APIstub, AdminUserId, userHistory)
 
-	result := IssueNewPointResult{Status: StatusOk, AdminBalance: adminBalance}
-	resultAsBytes, _ := json.Marshal(result)
+	// 監査用の発行記録
+	s.putIssuanceRecord(APIstub, DefaultTokenType, AdminUserId, point)
 
-	return shim.Success(resultAsBytes)
+	return adminBalance
 }
 
 // The main function is only relevant in unit test mode. Only included here for completeness.
@@ -0,0 +1,162 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+type TransferRecord struct {
+	TxId        string   `json:"tx_id"`                // "e3b0c442..."
+	TokenType   string   `json:"token_type,omitempty"` // "thanks"(デフォルトのポイントは空)
+	FromUserId  string   `json:"from_user_id"`         // "0001"
+	ToUserId    string   `json:"to_user_id"`           // "1725"
+	Point       float32  `json:"price"`                // 300.000
+	Refunded    float32  `json:"refunded"`             // 100.000
+	RefundTxIds []string `json:"refund_tx_ids"`        // ["a1b2c3d4..."]
+	RefundOf    string   `json:"refund_of"`            // 返金の場合は返金元の取引のTxID
+	CreatedAt   string   `json:"created_at"`           // "2018-07-01 20:32:11 UTC"
+}
+
+type GetTransferResult struct {
+	Status   Status         `json:"status"`
+	Transfer TransferRecord `json:"transfer"`
+}
+
+type RefundResult struct {
+	Status          Status         `json:"status"`
+	Original        TransferRecord `json:"original"`
+	RefundTxId      string         `json:"refund_tx_id"`
+	FromUserBalance Balance        `json:"from_user_balance"`
+	ToUserBalance   Balance        `json:"to_user_balance"`
+}
+
+// TransferRecord用Stateキー作成関数
+func (s *SmartContract) makeTransferRecordKey(txId string) string {
+	return "transfer_" + txId
+}
+
+// 指定TxIDの取引データ取得
+func (s *SmartContract) getTransferRecord(APIstub shim.ChaincodeStubInterface, txId string) TransferRecord {
+	recordAsBytes, _ := APIstub.GetState(s.makeTransferRecordKey(txId))
+	record := TransferRecord{}
+
+	if len(recordAsBytes) != 0 {
+		json.Unmarshal(recordAsBytes, &record)
+	}
+
+	return record
+}
+
+// 取引データput
+func (s *SmartContract) putTransferRecord(APIstub shim.ChaincodeStubInterface, record TransferRecord) {
+	recordAsBytes, _ := json.Marshal(record)
+	APIstub.PutState(s.makeTransferRecordKey(record.TxId), recordAsBytes)
+}
+
+// 元の取引を参照して譲渡先から譲渡元へ返金する
+// 管理者か元の取引の譲渡先のみ実行でき、元の取引額を超える返金はできない
+func (s *SmartContract) refund(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	originalTxId := args[0]
+	val, err := strconv.ParseFloat(args[1], 32)
+	if err != nil || val <= 0 {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	total := float32(val)
+
+	original := s.getTransferRecord(APIstub, originalTxId)
+	if original.TxId == "" {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "元の取引が見つかりませんでした")
+	}
+	if original.RefundOf != "" {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "返金取引は返金できません")
+	}
+
+	// 管理者か元の取引の譲渡先のみ返金可能
+	invokerId := s.getInvokerId(APIstub)
+	if invokerId != AdminUserId && invokerId != original.ToUserId {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "返金の権限がありません")
+	}
+
+	if total > original.Point-original.Refunded {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "元の取引額を超えて返金はできません")
+	}
+
+	// 元の譲渡先の残高から返金する
+	fromBalance := s.getUserTokenBalance(APIstub, original.TokenType, original.ToUserId)
+	if !s.isValidBalance(fromBalance) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "返金元の残高が見つかりませんでした")
+	}
+	if status, message := s.checkOutgoing(s.getUserBalance(APIstub, original.ToUserId)); status != StatusOk {
+		return s.makeErrorResponce(APIstub, status, message)
+	}
+	if status, message := s.checkIncoming(s.getUserBalance(APIstub, original.FromUserId)); status != StatusOk {
+		return s.makeErrorResponce(APIstub, status, message)
+	}
+	fromBalance = s.releaseExpiredHolds(APIstub, fromBalance)
+
+	if !s.hasEnoughBalance(APIstub, fromBalance, total) {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "返金元の残高が足りません")
+	}
+
+	fromBalance, toBalance := s.applyTransfer(APIstub, fromBalance, original.FromUserId, total, original.TxId)
+
+	// 元の取引に返金を紐付ける
+	original.Refunded += total
+	original.RefundTxIds = append(original.RefundTxIds, APIstub.GetTxID())
+	s.putTransferRecord(APIstub, original)
+
+	result := RefundResult{
+		Status:          StatusOk,
+		Original:        original,
+		RefundTxId:      APIstub.GetTxID(),
+		FromUserBalance: fromBalance,
+		ToUserBalance:   toBalance,
+	}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+func (s *SmartContract) getTransfer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	record := s.getTransferRecord(APIstub, args[0])
+
+	result := GetTransferResult{Status: StatusOk, Transfer: record}
+	if record.TxId == "" {
+		result.Status = StatusNotFound
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+	return shim.Success(resultAsBytes)
+}
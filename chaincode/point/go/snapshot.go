@@ -0,0 +1,375 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+type BalanceSnapshot struct {
+	UserId    string  `json:"user_id"`              // "1725"
+	TokenType string  `json:"token_type,omitempty"` // "point"以外の場合のみ
+	Month     string  `json:"month"`                // "201807"
+	Amount    float32 `json:"amount"`               // 2000.000 (月末時点の残高、仮押さえ分を含む)
+}
+
+type BalanceOpening struct {
+	Month  string             `json:"month"`            // "201808"
+	Amount float32            `json:"amount"`           // 1700.000 (月初時点の残高、仮押さえ分を含む)
+	Deltas map[string]float32 `json:"deltas,omitempty"` // {"201807": 300.000} (集約した差分の計上月毎の合計)
+}
+
+type SnapshotTokenSummary struct {
+	TokenType  string  `json:"token_type"`  // "point"
+	AccountNum int     `json:"account_num"` // 25
+	Total      float64 `json:"total"`       // 10000.000
+}
+
+type SnapshotSummary struct {
+	Month     string                 `json:"month"`    // "201807"
+	TxId      string                 `json:"tx_id"`    // "e3b0c442..."
+	TakenAt   string                 `json:"taken_at"` // "2018-08-01 00:05:00 UTC"
+	TakenBy   string                 `json:"taken_by"` // "admin"
+	Summaries []SnapshotTokenSummary `json:"summaries"`
+}
+
+type SnapshotSummaryResult struct {
+	Status  Status          `json:"status"`
+	Summary SnapshotSummary `json:"summary"`
+}
+
+type GetBalanceAtResult struct {
+	Status   Status          `json:"status"`
+	Snapshot BalanceSnapshot `json:"snapshot"`
+}
+
+// スナップショットの複合キー
+const balanceSnapshotIndexName = "snapshot~balance"
+
+// 月初時点の残高の記録の複合キー
+// 基準残高・分割残高は月が変わって最初の更新時に、集約した前月以前の差分は集約時に記録する
+const balanceOpeningIndexName = "balance~opening"
+
+// 月初時点の残高を記録する残高の種類(分割残高はmakeSlotOpeningRecordで作成する)
+const (
+	BalanceOpeningBase  = "base"
+	BalanceOpeningDelta = "delta"
+)
+
+// BalanceSnapshot用Stateキー作成関数
+// ユーザーIDとポイント種別を区別できるよう複合キーとする
+func (s *SmartContract) makeBalanceSnapshotKey(APIstub shim.ChaincodeStubInterface, month string, tokenType string, userId string) string {
+	if s.isDefaultTokenType(tokenType) {
+		tokenType = DefaultTokenType
+	}
+	key, _ := APIstub.CreateCompositeKey(balanceSnapshotIndexName, []string{month, tokenType, userId})
+	return key
+}
+
+// 指定月末時点の指定ユーザー・指定ポイント種別のスナップショット取得
+func (s *SmartContract) getBalanceSnapshot(APIstub shim.ChaincodeStubInterface, month string, tokenType string, userId string) (BalanceSnapshot, bool) {
+	snapshotAsBytes, _ := APIstub.GetState(s.makeBalanceSnapshotKey(APIstub, month, tokenType, userId))
+	snapshot := BalanceSnapshot{}
+
+	if len(snapshotAsBytes) == 0 {
+		return snapshot, false
+	}
+	json.Unmarshal(snapshotAsBytes, &snapshot)
+
+	return snapshot, true
+}
+
+// 月初時点の残高の記録用Stateキー作成関数
+func (s *SmartContract) makeBalanceOpeningKey(APIstub shim.ChaincodeStubInterface, tokenType string, userId string, record string, month string) string {
+	if s.isDefaultTokenType(tokenType) {
+		tokenType = DefaultTokenType
+	}
+	key, _ := APIstub.CreateCompositeKey(balanceOpeningIndexName, []string{tokenType, userId, record, month})
+	return key
+}
+
+// 分割残高の月初時点の残高を記録する種類名
+func (s *SmartContract) makeSlotOpeningRecord(slot int) string {
+	return fmt.Sprintf("slot%02d", slot)
+}
+
+// SnapshotSummary用Stateキー作成関数
+func (s *SmartContract) makeSnapshotSummaryKey(month string) string {
+	return "snapshot_summary_" + month
+}
+
+// 指定月のスナップショットの集計取得
+func (s *SmartContract) getSnapshotSummaryFromState(APIstub shim.ChaincodeStubInterface, month string) SnapshotSummary {
+	summaryAsBytes, _ := APIstub.GetState(s.makeSnapshotSummaryKey(month))
+	summary := SnapshotSummary{}
+
+	if len(summaryAsBytes) != 0 {
+		json.Unmarshal(summaryAsBytes, &summary)
+	}
+
+	return summary
+}
+
+// 月初時点の残高の記録を取得する
+func (s *SmartContract) getBalanceOpening(APIstub shim.ChaincodeStubInterface, tokenType string, userId string, record string, month string) BalanceOpening {
+	openingAsBytes, _ := APIstub.GetState(s.makeBalanceOpeningKey(APIstub, tokenType, userId, record, month))
+	opening := BalanceOpening{Month: month}
+
+	if len(openingAsBytes) != 0 {
+		json.Unmarshal(openingAsBytes, &opening)
+	}
+
+	return opening
+}
+
+// 月初時点の残高の記録put
+func (s *SmartContract) putBalanceOpening(APIstub shim.ChaincodeStubInterface, tokenType string, userId string, record string, opening BalanceOpening) {
+	openingAsBytes, _ := json.Marshal(opening)
+	APIstub.PutState(s.makeBalanceOpeningKey(APIstub, tokenType, userId, record, opening.Month), openingAsBytes)
+}
+
+// 現在のStateと月初時点の残高の記録から指定月末時点の残高を求める(仮押さえ分を含む)
+// 基準残高・分割残高はそれぞれ指定月より後で最初の記録(なければ現在の残高)を使う
+// 未集約の差分は指定月までに計上したものを、指定月より後に集約した差分の記録と現在の差分から合算する
+func (s *SmartContract) getMonthClosingBalance(APIstub shim.ChaincodeStubInterface, balance Balance, month string) (float32, error) {
+	currents := map[string]float32{BalanceOpeningBase: balance.Amount + balance.Held}
+	var amount float32
+
+	if s.isDefaultTokenType(balance.TokenType) {
+		slots, err := s.getHotBalanceSlots(APIstub, balance.UserId)
+		if err != nil {
+			return 0, err
+		}
+		for _, slot := range slots {
+			currents[s.makeSlotOpeningRecord(slot.Slot)] += slot.Amount
+		}
+
+		deltas, err := s.getBalanceDeltas(APIstub, balance.UserId)
+		if err != nil {
+			return 0, err
+		}
+		for _, delta := range deltas {
+			if delta.Month <= month {
+				amount += delta.Amount + delta.Held
+			}
+		}
+	}
+
+	tokenType := balance.TokenType
+	if s.isDefaultTokenType(tokenType) {
+		tokenType = DefaultTokenType
+	}
+	openingIterator, err := APIstub.GetStateByPartialCompositeKey(balanceOpeningIndexName, []string{tokenType, balance.UserId})
+	if err != nil {
+		return 0, err
+	}
+	defer openingIterator.Close()
+
+	// 記録は残高の種類毎に月の昇順で返る
+	found := map[string]bool{}
+	for openingIterator.HasNext() {
+		queryResponse, err := openingIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+		_, attributes, err := APIstub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(attributes) != 4 || attributes[3] <= month {
+			continue
+		}
+		record := attributes[2]
+		opening := BalanceOpening{}
+		json.Unmarshal(queryResponse.Value, &opening)
+
+		if record == BalanceOpeningDelta {
+			for deltaMonth, deltaAmount := range opening.Deltas {
+				if deltaMonth <= month {
+					amount += deltaAmount
+				}
+			}
+			continue
+		}
+		if !found[record] {
+			found[record] = true
+			currents[record] = opening.Amount
+		}
+	}
+
+	for _, current := range currents {
+		amount += current
+	}
+
+	return amount, nil
+}
+
+// 指定月末時点の全口座の残高を記録する(管理者のみ)
+// 締めた月(当月より前)であればいつでも実行でき、現在の残高と月初時点の残高の記録から指定月末時点の残高を求める
+// 同じ月のスナップショットは1回のみ作成できる
+func (s *SmartContract) snapshotBalances(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	month, err := time.Parse(MonthFormat, args[0])
+	if err != nil {
+		return shim.Error("Incorrect type of arguments.")
+	}
+
+	if !s.isAdminInvoker(APIstub) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "管理者のみ実行できます")
+	}
+
+	currentMonth, _ := time.Parse(MonthFormat, s.getTxTime(APIstub).Format(MonthFormat))
+	if !month.Before(currentMonth) {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "締めていない月は指定できません")
+	}
+
+	monthStr := month.Format(MonthFormat)
+	if s.getSnapshotSummaryFromState(APIstub, monthStr).Month != "" {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "スナップショットは作成済みです")
+	}
+
+	summaries := map[string]*SnapshotTokenSummary{}
+	var closingErr error
+	err = s.scanBalances(APIstub, func(key string, value []byte) {
+		balance := Balance{}
+		if err := json.Unmarshal(value, &balance); err != nil || !s.isValidBalance(balance) || !s.isBalanceKeyOf(APIstub, key, balance) {
+			return
+		}
+
+		amount, err := s.getMonthClosingBalance(APIstub, balance, monthStr)
+		if err != nil {
+			closingErr = err
+			return
+		}
+
+		snapshot := BalanceSnapshot{
+			UserId:    balance.UserId,
+			TokenType: balance.TokenType,
+			Month:     monthStr,
+			Amount:    amount,
+		}
+		snapshotAsBytes, _ := json.Marshal(snapshot)
+		APIstub.PutState(s.makeBalanceSnapshotKey(APIstub, monthStr, snapshot.TokenType, snapshot.UserId), snapshotAsBytes)
+
+		tokenType := balance.TokenType
+		if s.isDefaultTokenType(tokenType) {
+			tokenType = DefaultTokenType
+		}
+		if _, ok := summaries[tokenType]; !ok {
+			summaries[tokenType] = &SnapshotTokenSummary{TokenType: tokenType}
+		}
+		summaries[tokenType].AccountNum++
+		summaries[tokenType].Total += float64(amount)
+	})
+	if err == nil {
+		err = closingErr
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	tokenTypes := []string{}
+	for tokenType := range summaries {
+		tokenTypes = append(tokenTypes, tokenType)
+	}
+	sort.Strings(tokenTypes)
+
+	summary := SnapshotSummary{
+		Month:     monthStr,
+		TxId:      APIstub.GetTxID(),
+		TakenAt:   s.getTxTime(APIstub).Format(DateTimeFormat),
+		TakenBy:   s.getInvokerId(APIstub),
+		Summaries: []SnapshotTokenSummary{},
+	}
+	for _, tokenType := range tokenTypes {
+		summary.Summaries = append(summary.Summaries, *summaries[tokenType])
+	}
+	summaryAsBytes, _ := json.Marshal(summary)
+	APIstub.PutState(s.makeSnapshotSummaryKey(monthStr), summaryAsBytes)
+
+	result := SnapshotSummaryResult{Status: StatusOk, Summary: summary}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// スナップショットから指定月末時点の残高を取得する
+// 3つ目の引数でポイント種別を指定できる(省略時はデフォルトのポイント)
+func (s *SmartContract) getBalanceAt(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or 3")
+	}
+
+	userId := args[0]
+	month, err := time.Parse(MonthFormat, args[1])
+	if err != nil {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	tokenType := DefaultTokenType
+	if len(args) == 3 {
+		tokenType = args[2]
+	}
+
+	monthStr := month.Format(MonthFormat)
+	if s.getSnapshotSummaryFromState(APIstub, monthStr).Month == "" {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "指定月のスナップショットがありません")
+	}
+
+	snapshot, ok := s.getBalanceSnapshot(APIstub, monthStr, tokenType, userId)
+	if !ok {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "指定月末時点の残高が見つかりませんでした")
+	}
+
+	result := GetBalanceAtResult{Status: StatusOk, Snapshot: snapshot}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 指定月のスナップショットの集計を取得する
+func (s *SmartContract) getSnapshotSummary(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	month, err := time.Parse(MonthFormat, args[0])
+	if err != nil {
+		return shim.Error("Incorrect type of arguments.")
+	}
+
+	summary := s.getSnapshotSummaryFromState(APIstub, month.Format(MonthFormat))
+	if summary.Month == "" {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "指定月のスナップショットがありません")
+	}
+
+	result := SnapshotSummaryResult{Status: StatusOk, Summary: summary}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
@@ -0,0 +1,148 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+type StatementEntry struct {
+	TxId           string  `json:"tx_id"`           // "e3b0c442..."
+	CreatedAt      string  `json:"created_at"`      // "2018-07-01 20:32:11 UTC"
+	CounterpartyId string  `json:"counterparty_id"` // "0001"
+	Credit         float32 `json:"credit"`          // 300.000
+	Debit          float32 `json:"debit"`           // 0.000
+	Fee            float32 `json:"fee"`             // 0.000
+}
+
+type Statement struct {
+	UserId         string           `json:"user_id"`         // "1725"
+	Month          string           `json:"month"`           // "201807"
+	OpeningBalance float32          `json:"opening_balance"` // 1700.000
+	Entries        []StatementEntry `json:"entries"`
+	TotalIn        float32          `json:"total_in"`        // 300.000
+	TotalOut       float32          `json:"total_out"`       // 0.000
+	TotalFee       float32          `json:"total_fee"`       // 0.000
+	ClosingBalance float32          `json:"closing_balance"` // 2000.000
+}
+
+type GetStatementResult struct {
+	Status    Status    `json:"status"`
+	Statement Statement `json:"statement"`
+}
+
+// 取引明細から明細書の1行を作成する
+func (s *SmartContract) makeStatementEntry(history TransferHistoryWithTimestamp) StatementEntry {
+	entry := StatementEntry{
+		TxId:      history.TxId,
+		CreatedAt: history.CreatedAt,
+		Fee:       history.Fee,
+	}
+
+	if history.Point < 0 {
+		entry.CounterpartyId = history.ToUserId
+		entry.Debit = -history.Point
+	} else {
+		entry.CounterpartyId = history.FromUserId
+		entry.Credit = history.Point
+	}
+
+	return entry
+}
+
+// 指定月末時点の残高を求める
+// 現在の残高(仮押さえ分を含む)から指定月より後の増減を差し引く
+func (s *SmartContract) getClosingBalance(APIstub shim.ChaincodeStubInterface, balance Balance, month time.Time) (float32, error) {
+	currentMonth, _ := time.Parse(MonthFormat, s.getTxTime(APIstub).Format(MonthFormat))
+
+	// 指定月より後の増減合計
+	var laterNet float32
+	for m := month.AddDate(0, 1, 0); !m.After(currentMonth); m = m.AddDate(0, 1, 0) {
+		histories, err := s.getTransferHistories(APIstub, balance.TokenType, balance.UserId, m.Format(MonthFormat))
+		if err != nil {
+			return 0, err
+		}
+		for _, history := range histories {
+			laterNet += history.Point
+		}
+	}
+
+	return balance.Amount + balance.Held - laterNet, nil
+}
+
+// 指定月の期首・期末残高と取引一覧をまとめた明細書を取得する
+// 期末残高は現在の残高(仮押さえ分を含む)から指定月より後の増減を差し引いて求める
+func (s *SmartContract) getStatement(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	userId := args[0]
+	month, err := time.Parse(MonthFormat, args[1])
+	if err != nil {
+		return shim.Error("Incorrect type of arguments.")
+	}
+
+	currentMonth, _ := time.Parse(MonthFormat, s.getTxTime(APIstub).Format(MonthFormat))
+	if month.After(currentMonth) {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "未来の月は指定できません")
+	}
+
+	balance := s.addPendingDeltas(APIstub, s.getUserBalance(APIstub, userId))
+	if !s.isValidBalance(balance) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "残高が見つかりませんでした")
+	}
+
+	statement := Statement{
+		UserId:  userId,
+		Month:   month.Format(MonthFormat),
+		Entries: []StatementEntry{},
+	}
+
+	closingBalance, err := s.getClosingBalance(APIstub, balance, month)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	histories, err := s.getTransferHistories(APIstub, DefaultTokenType, userId, statement.Month)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, history := range histories {
+		entry := s.makeStatementEntry(history)
+		statement.Entries = append(statement.Entries, entry)
+		statement.TotalIn += entry.Credit
+		statement.TotalOut += entry.Debit
+		statement.TotalFee += entry.Fee
+	}
+
+	statement.ClosingBalance = closingBalance
+	statement.OpeningBalance = statement.ClosingBalance - statement.TotalIn + statement.TotalOut
+
+	result := GetStatementResult{Status: StatusOk, Statement: statement}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
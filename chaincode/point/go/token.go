@@ -0,0 +1,304 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 従来の単一ポイントを表すデフォルトのポイント種別
+const DefaultTokenType string = "point"
+
+// デフォルト以外のポイント種別の残高・取引明細の複合キー
+const tokenBalanceIndexName = "balance~token"
+const tokenTransferBillIndexName = "transfer_bill~token"
+
+type TokenType struct {
+	TokenType string `json:"token_type"` // "thanks"
+	Name      string `json:"name"`       // "サンクスポイント"
+	IssuerId  string `json:"issuer_id"`  // "hr_admin"
+	CreatedAt string `json:"created_at"` // "2018-07-01 20:32:11 UTC"
+}
+
+type TokenTypeResult struct {
+	Status    Status    `json:"status"`
+	TokenType TokenType `json:"token_type"`
+}
+
+type ListTokenTypesResult struct {
+	Status     Status      `json:"status"`
+	TokenTypes []TokenType `json:"token_types"`
+}
+
+type IssueTokenResult struct {
+	Status        Status  `json:"status"`
+	IssuerBalance Balance `json:"issuer_balance"`
+}
+
+// TokenType用Stateキー作成関数
+func (s *SmartContract) makeTokenTypeKey(tokenType string) string {
+	return "token_type_" + tokenType
+}
+
+// デフォルトのポイント種別かどうか
+func (s *SmartContract) isDefaultTokenType(tokenType string) bool {
+	return tokenType == "" || tokenType == DefaultTokenType
+}
+
+// 指定ポイント種別のデータ取得
+func (s *SmartContract) getTokenTypeFromState(APIstub shim.ChaincodeStubInterface, tokenType string) TokenType {
+	tokenTypeAsBytes, _ := APIstub.GetState(s.makeTokenTypeKey(tokenType))
+	result := TokenType{}
+
+	if len(tokenTypeAsBytes) != 0 {
+		json.Unmarshal(tokenTypeAsBytes, &result)
+	}
+
+	return result
+}
+
+// 指定ポイント種別の発行者を取得する
+// デフォルトのポイントの種別データがない場合は管理者とする
+func (s *SmartContract) getTokenIssuerId(APIstub shim.ChaincodeStubInterface, tokenType string) string {
+	issuerId := s.getTokenTypeFromState(APIstub, tokenType).IssuerId
+	if issuerId == "" && s.isDefaultTokenType(tokenType) {
+		return AdminUserId
+	}
+	return issuerId
+}
+
+// ポイント種別データput
+func (s *SmartContract) putTokenType(APIstub shim.ChaincodeStubInterface, tokenType TokenType) {
+	tokenTypeAsBytes, _ := json.Marshal(tokenType)
+	APIstub.PutState(s.makeTokenTypeKey(tokenType.TokenType), tokenTypeAsBytes)
+}
+
+// デフォルトのポイント種別の初期化
+func (s *SmartContract) initDefaultTokenType(APIstub shim.ChaincodeStubInterface) {
+	if s.getTokenTypeFromState(APIstub, DefaultTokenType).TokenType != "" {
+		return
+	}
+
+	s.putTokenType(APIstub, TokenType{
+		TokenType: DefaultTokenType,
+		Name:      DefaultTokenType,
+		IssuerId:  AdminUserId,
+		CreatedAt: s.getTxTime(APIstub).Format(DateTimeFormat),
+	})
+}
+
+// 登録済みのポイント種別をすべて取得する
+func (s *SmartContract) getTokenTypes(APIstub shim.ChaincodeStubInterface) ([]TokenType, error) {
+	startKey := s.makeTokenTypeKey("")
+	endKey := s.makeTokenTypeKey(string(utf8.MaxRune))
+
+	resultsIterator, err := APIstub.GetStateByRange(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var tokenTypes []TokenType
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		tokenType := TokenType{}
+		json.Unmarshal(queryResponse.Value, &tokenType)
+		tokenTypes = append(tokenTypes, tokenType)
+	}
+
+	return tokenTypes, nil
+}
+
+// ポイント種別を登録する(管理者のみ)
+func (s *SmartContract) registerTokenType(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	tokenType := args[0]
+	name := args[1]
+	issuerId := args[2]
+
+	if tokenType == "" || issuerId == "" {
+		return shim.Error("Incorrect type of arguments.")
+	}
+
+	if !s.isAdminInvoker(APIstub) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "管理者のみ実行できます")
+	}
+	if s.isDefaultTokenType(tokenType) || s.getTokenTypeFromState(APIstub, tokenType).TokenType != "" {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "登録済みのポイント種別です")
+	}
+
+	result := TokenTypeResult{
+		Status: StatusOk,
+		TokenType: TokenType{
+			TokenType: tokenType,
+			Name:      name,
+			IssuerId:  issuerId,
+			CreatedAt: s.getTxTime(APIstub).Format(DateTimeFormat),
+		},
+	}
+	s.putTokenType(APIstub, result.TokenType)
+
+	resultAsBytes, _ := json.Marshal(result)
+	return shim.Success(resultAsBytes)
+}
+
+func (s *SmartContract) listTokenTypes(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	tokenTypes, err := s.getTokenTypes(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result := ListTokenTypesResult{Status: StatusOk, TokenTypes: tokenTypes}
+	if len(tokenTypes) < 1 {
+		result.Status = StatusNotFound
+	}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+func (s *SmartContract) getTokenBalance(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	balance := s.getUserTokenBalance(APIstub, args[0], args[1])
+	balance = s.addPendingDeltas(APIstub, balance)
+
+	result := GetBalanceResult{Status: StatusOk, Balance: balance, Holds: []Hold{}}
+	if balance.UserId == "" {
+		result.Status = StatusNotFound
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+	return shim.Success(resultAsBytes)
+}
+
+func (s *SmartContract) getTokenHistory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	transferHistories, err := s.getTransferHistories(APIstub, args[0], args[1], args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result := GetHistoryResult{Status: StatusOk, History: transferHistories}
+	if len(transferHistories) < 1 {
+		result.Status = StatusNotFound
+	}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+func (s *SmartContract) transferToken(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	tokenType := args[0]
+	fromUserId := args[1]
+	toUserId := args[2]
+	point, err := strconv.ParseFloat(args[3], 32)
+	if err != nil || point <= 0 {
+		return shim.Error("Incorrect type of arguments.")
+	}
+
+	if s.getTokenTypeFromState(APIstub, tokenType).TokenType == "" {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "ポイント種別が見つかりませんでした")
+	}
+
+	return s.executeTransfer(APIstub, tokenType, fromUserId, toUserId, float32(point))
+}
+
+// 指定ポイント種別を発行者の残高に発行する(発行者のみ)
+func (s *SmartContract) issueToken(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	tokenType := args[0]
+	val, err := strconv.ParseFloat(args[1], 32)
+	if err != nil || val <= 0 {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	point := float32(val)
+
+	// デフォルトのポイントは承認ポリシーを適用するissueNewPointでのみ発行できる
+	if s.isDefaultTokenType(tokenType) {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "デフォルトのポイントはissueNewPointで発行してください")
+	}
+
+	tokenTypeData := s.getTokenTypeFromState(APIstub, tokenType)
+	if tokenTypeData.TokenType == "" {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "ポイント種別が見つかりませんでした")
+	}
+	if s.getInvokerId(APIstub) != tokenTypeData.IssuerId {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "ポイント種別の発行者のみ実行できます")
+	}
+
+	// 発行者の残高の取得
+	issuerBalance := s.getUserTokenBalance(APIstub, tokenType, tokenTypeData.IssuerId)
+	if !s.isValidBalance(issuerBalance) {
+		issuerBalance = s.makeEmptyTokenBalance(tokenType, tokenTypeData.IssuerId)
+	}
+
+	// balanceを更新
+	issuerBalance = s.updateBalance(APIstub, issuerBalance, point, point)
+
+	// 履歴を更新
+	s.putTransferBill(APIstub, tokenTypeData.IssuerId, TransferHistory{
+		TokenType:  issuerBalance.TokenType,
+		ToUserId:   tokenTypeData.IssuerId,
+		FromUserId: tokenTypeData.IssuerId,
+		Point:      point,
+	})
+
+	// 監査用の発行記録
+	s.putIssuanceRecord(APIstub, tokenType, tokenTypeData.IssuerId, point)
+
+	result := IssueTokenResult{Status: StatusOk, IssuerBalance: issuerBalance}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
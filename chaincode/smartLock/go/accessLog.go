@@ -0,0 +1,243 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+type AccessOutcome string
+
+const (
+	AccessOutcomeGranted AccessOutcome = "granted"
+	AccessOutcomeDenied  AccessOutcome = "denied"
+)
+
+// アクセスログのインデックスの日付の書式
+const AccessLogDateFormat = "20060102"
+
+// アクセスログを1度に検索できる最大日数
+const MaxAccessLogDays = 31
+
+const accessLogLockerIndexName = "access~locker"
+const accessLogUserIndexName = "access~user"
+const accessLogOverrideIndexName = "access~override"
+
+// ロッカーの開閉の試行1回分の記録
+// 追記のみで更新・削除はしない
+type AccessEvent struct {
+	EventId         string        `json:"event_id"`                // "e3b0c442..."(TxID)
+	LockerId        string        `json:"locker_id"`               // "box_0001"
+	UserId          string        `json:"user_id"`                 // "kohun_0001"
+	GuestCodeId     string        `json:"guest_code_id,omitempty"` // "e3b0c442..." (ゲストコードで操作した場合のみ)
+	RequestedStatus LockerStatus  `json:"requested_status"`        // "unlocked"
+	Outcome         AccessOutcome `json:"outcome"`                 // "denied"
+	Status          Status        `json:"status"`                  // 405
+	Reason          string        `json:"reason"`                  // "対象のロッカーの開錠権限がありません"
+	InvokerId       string        `json:"invoker_id"`              // "terminal_3f"
+	IsOverride      bool          `json:"is_override"`             // false (マスター権限で開錠した場合はtrue)
+	Justification   string        `json:"justification,omitempty"` // "閉じ込められた荷物の回収のため"
+	CreatedAt       string        `json:"created_at"`              // "2018-09-22 20:32:11 UTC"
+}
+
+type GetAccessLogResult struct {
+	Status       Status        `json:"status"`
+	AccessEvents []AccessEvent `json:"access_events"`
+}
+
+// アクセスログの記録を作成する(記録は結果を設定してから行う)
+func (s *SmartContract) makeAccessEvent(APIstub shim.ChaincodeStubInterface, userId string, lockerId string, toStatus LockerStatus, now time.Time) AccessEvent {
+	return AccessEvent{
+		EventId:         APIstub.GetTxID(),
+		LockerId:        lockerId,
+		UserId:          userId,
+		RequestedStatus: toStatus,
+		InvokerId:       s.getInvokerId(APIstub),
+		CreatedAt:       now.Format(DateTimeFormat),
+	}
+}
+
+// アクセスログput
+// ロッカー毎、ユーザー毎に日付単位で検索できるよう、インデックスに記録そのものを持たせる
+func (s *SmartContract) putAccessEvent(APIstub shim.ChaincodeStubInterface, accessEvent AccessEvent) {
+	createdAt, _ := time.Parse(DateTimeFormat, accessEvent.CreatedAt)
+	date := createdAt.Format(AccessLogDateFormat)
+	accessEventAsBytes, _ := json.Marshal(accessEvent)
+
+	lockerIndexKey, _ := APIstub.CreateCompositeKey(accessLogLockerIndexName, []string{accessEvent.LockerId, date, accessEvent.EventId})
+	APIstub.PutState(lockerIndexKey, accessEventAsBytes)
+
+	// マスター権限での操作は見直しのため別にも記録する
+	if accessEvent.IsOverride {
+		overrideIndexKey, _ := APIstub.CreateCompositeKey(accessLogOverrideIndexName, []string{date, accessEvent.EventId})
+		APIstub.PutState(overrideIndexKey, accessEventAsBytes)
+	}
+
+	// 自動施錠などユーザーによらない操作はロッカー毎にのみ記録する
+	if accessEvent.UserId == "" {
+		return
+	}
+	userIndexKey, _ := APIstub.CreateCompositeKey(accessLogUserIndexName, []string{accessEvent.UserId, date, accessEvent.EventId})
+	APIstub.PutState(userIndexKey, accessEventAsBytes)
+}
+
+// 許可した試行をアクセスログに記録する
+func (s *SmartContract) grantAccess(APIstub shim.ChaincodeStubInterface, accessEvent AccessEvent) {
+	accessEvent.Outcome = AccessOutcomeGranted
+	accessEvent.Status = StatusOk
+	s.putAccessEvent(APIstub, accessEvent)
+}
+
+// 拒否した試行をアクセスログに記録してエラーレスポンスを返す
+func (s *SmartContract) denyAccess(APIstub shim.ChaincodeStubInterface, accessEvent AccessEvent, code Status, message string) sc.Response {
+	accessEvent.Outcome = AccessOutcomeDenied
+	accessEvent.Status = code
+	accessEvent.Reason = message
+	s.putAccessEvent(APIstub, accessEvent)
+
+	return s.makeErrorResponce(APIstub, code, message)
+}
+
+// 期間の引数を解釈する
+func (s *SmartContract) parseAccessLogPeriod(fromArg string, untilArg string) (time.Time, time.Time, bool) {
+	from, err := time.Parse(DateTimeFormat, fromArg)
+	if err != nil {
+		return from, from, false
+	}
+	until, err := time.Parse(DateTimeFormat, untilArg)
+	if err != nil {
+		return from, until, false
+	}
+	return from, until, true
+}
+
+// 指定したインデックスから期間内のアクセスログを日時順に取得する
+// keyPrefixは日付より前のインデックスの属性(ロッカーIDなど)
+// 期間は開始を含み終了を含まない
+func (s *SmartContract) getAccessEvents(APIstub shim.ChaincodeStubInterface, indexName string, keyPrefix []string, from time.Time, until time.Time) ([]AccessEvent, error) {
+	accessEvents := []AccessEvent{}
+
+	firstDate, _ := time.Parse(AccessLogDateFormat, from.Format(AccessLogDateFormat))
+	for date := firstDate; date.Before(until); date = date.AddDate(0, 0, 1) {
+		attributes := append(append([]string{}, keyPrefix...), date.Format(AccessLogDateFormat))
+		indexIterator, err := APIstub.GetStateByPartialCompositeKey(indexName, attributes)
+		if err != nil {
+			return nil, err
+		}
+
+		for indexIterator.HasNext() {
+			queryResponse, err := indexIterator.Next()
+			if err != nil {
+				indexIterator.Close()
+				return nil, err
+			}
+			accessEvent := AccessEvent{}
+			if err := json.Unmarshal(queryResponse.Value, &accessEvent); err != nil {
+				continue
+			}
+			createdAt, err := time.Parse(DateTimeFormat, accessEvent.CreatedAt)
+			if err != nil || createdAt.Before(from) || !createdAt.Before(until) {
+				continue
+			}
+			accessEvents = append(accessEvents, accessEvent)
+		}
+		indexIterator.Close()
+	}
+
+	sort.SliceStable(accessEvents, func(i, j int) bool {
+		return accessEvents[i].CreatedAt < accessEvents[j].CreatedAt
+	})
+
+	return accessEvents, nil
+}
+
+// ロッカー毎のアクセスログを期間を指定して取得する(ロッカーの管理者のみ)
+// 引数はロッカーID、期間の開始、終了
+func (s *SmartContract) getLockerAccessLog(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	lockerId := args[0]
+	from, until, ok := s.parseAccessLogPeriod(args[1], args[2])
+	if !ok {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	if !until.After(from) || until.Sub(from) > MaxAccessLogDays*24*time.Hour {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "検索期間が不正です")
+	}
+
+	// 廃止済みのロッカーのログも調査できるよう、存在のみチェックする
+	lockerData := s.getLockerDataFromState(APIstub, lockerId)
+	if lockerData.LockerId == "" {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のロッカーが存在しません")
+	}
+	if !s.canManageLocker(APIstub, lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "対象のロッカーの管理権限がありません")
+	}
+
+	accessEvents, err := s.getAccessEvents(APIstub, accessLogLockerIndexName, []string{lockerId}, from, until)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result := GetAccessLogResult{Status: StatusOk, AccessEvents: accessEvents}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// ユーザー毎のアクセスログを期間を指定して取得する(管理者のみ)
+// 引数はユーザーID、期間の開始、終了
+func (s *SmartContract) getUserAccessLog(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	userId := args[0]
+	from, until, ok := s.parseAccessLogPeriod(args[1], args[2])
+	if !ok {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	if !until.After(from) || until.Sub(from) > MaxAccessLogDays*24*time.Hour {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "検索期間が不正です")
+	}
+
+	if !s.isAdminInvoker(APIstub) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "管理者のみ実行できます")
+	}
+
+	accessEvents, err := s.getAccessEvents(APIstub, accessLogUserIndexName, []string{userId}, from, until)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result := GetAccessLogResult{Status: StatusOk, AccessEvents: accessEvents}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
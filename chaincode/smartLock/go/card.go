@@ -0,0 +1,374 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// カードの照合に続けて失敗できる回数
+// 失敗はコミットされたトランザクションでのみ記録されるため、endorsementのみの実行(シミュレーション)による総当たりは防げない
+// 操作停止は誤操作や不正なカードの提示を記録・抑止するためのもので、総当たりへの対策はカードIDmのハッシュの推測困難さに依る
+const MaxFailedCardAttempts = 5
+
+// 照合に続けて失敗した場合に操作を停止する期間
+const CardSuspendDuration = 15 * time.Minute
+
+const cardReplacementIndexName = "card_replacement~user"
+
+// 提示されたカードIDmのハッシュを渡すtransientデータのキー
+// 照合に使う値を台帳に残さないよう、引数ではなくtransientデータで受け取る
+const CardTransientKey = "card_idm_hash"
+
+// 差し替え後のカードIDmのハッシュを渡すtransientデータのキー
+const NewCardTransientKey = "new_card_idm_hash"
+
+type ResetCardSuspensionResult GetUserDataResult
+
+// カードの識別子の計算に使う固定のソルト
+// 識別子は照合に使うハッシュから計算するので、同じカードには同じソルトでハッシュ化したものを渡すこと
+const CardFingerprintSalt = "card_fingerprint"
+
+// 無効にしたカード
+// 照合用のデータは登録毎にソルトが変わるため、カードの識別子で記録する
+// 識別子は提示されたハッシュからチェーンコード側で計算したもので、照合には使えない
+type BlacklistedCard struct {
+	CardFingerprint string `json:"card_fingerprint"` // "3b4c1f0e..."
+	UserId          string `json:"user_id"`          // "kohun_0001"
+	BlacklistedAt   string `json:"blacklisted_at"`   // "2018-09-22 20:32:11 UTC"
+}
+
+type CardReplacement struct {
+	TxId               string `json:"tx_id"`                // "e3b0c442..."
+	UserId             string `json:"user_id"`              // "kohun_0001"
+	OldCardFingerprint string `json:"old_card_fingerprint"` // "3b4c1f0e..."
+	NewCardFingerprint string `json:"new_card_fingerprint"` // "a7d2e915..."
+	ReplacedBy         string `json:"replaced_by"`          // "admin"
+	ReplacedAt         string `json:"replaced_at"`          // "2018-09-22 20:32:11 UTC"
+}
+
+type ReplaceCardResult struct {
+	Status          Status          `json:"status"`
+	UserData        UserData        `json:"user_data"`
+	CardReplacement CardReplacement `json:"card_replacement"`
+}
+
+type GetCardReplacementHistoryResult struct {
+	Status           Status            `json:"status"`
+	CardReplacements []CardReplacement `json:"card_replacements"`
+}
+
+// transientデータからカードIDmのハッシュを取得する(なければ空文字)
+func (s *SmartContract) getCardHashFromTransient(APIstub shim.ChaincodeStubInterface, key string) string {
+	transient, err := APIstub.GetTransient()
+	if err != nil {
+		return ""
+	}
+	return string(transient[key])
+}
+
+// 照合用のデータを計算する
+func (s *SmartContract) hashCardIdm(salt string, cardIdmHash string) string {
+	hash := sha256.Sum256([]byte(salt + cardIdmHash))
+	return hex.EncodeToString(hash[:])
+}
+
+// 提示されたハッシュからカードの識別子を計算する
+func (s *SmartContract) makeCardFingerprint(cardIdmHash string) string {
+	return s.hashCardIdm(CardFingerprintSalt, cardIdmHash)
+}
+
+// 提示されたハッシュから照合用のソルトとデータを作る
+// ソルトはTxIDから作る(endorserごとに同じ値になるように)
+func (s *SmartContract) makeCardVerifier(APIstub shim.ChaincodeStubInterface, cardIdmHash string) (string, string) {
+	saltHash := sha256.Sum256([]byte(APIstub.GetTxID()))
+	salt := hex.EncodeToString(saltHash[:16])
+	return salt, s.hashCardIdm(salt, cardIdmHash)
+}
+
+// レスポンス用にカードの照合に使うデータを取り除く
+func (s *SmartContract) sanitizeUserData(userData UserData) UserData {
+	userData.CardFingerprint = ""
+	userData.CardIdmHash = ""
+	userData.CardSalt = ""
+	userData.CardVerifier = ""
+	userData.CardVerifierSalt = ""
+	return userData
+}
+
+// BlacklistedCard用Stateキー作成関数
+func (s *SmartContract) makeCardBlacklistKey(cardFingerprint string) string {
+	return "card_blacklist_" + cardFingerprint
+}
+
+// カードの識別子から登録したユーザーを引くためのStateキー作成関数
+func (s *SmartContract) makeCardFingerprintKey(cardFingerprint string) string {
+	return "card_fingerprint_" + cardFingerprint
+}
+
+// 無効にしたカードかどうか
+func (s *SmartContract) isBlacklistedCard(APIstub shim.ChaincodeStubInterface, cardFingerprint string) bool {
+	blacklistedAsBytes, _ := APIstub.GetState(s.makeCardBlacklistKey(cardFingerprint))
+	return len(blacklistedAsBytes) != 0
+}
+
+// 指定のカードを登録しているユーザーIDを取得する(なければ空文字)
+func (s *SmartContract) getCardOwnerId(APIstub shim.ChaincodeStubInterface, cardFingerprint string) string {
+	userIdAsBytes, _ := APIstub.GetState(s.makeCardFingerprintKey(cardFingerprint))
+	return string(userIdAsBytes)
+}
+
+// 登録できないカードかどうか判別し、できない場合は理由を返す
+// 無効にしたカードと、別のユーザーが登録しているカードは登録できない
+func (s *SmartContract) checkCardAvailable(APIstub shim.ChaincodeStubInterface, userId string, cardFingerprint string) (Status, string) {
+	if s.isBlacklistedCard(APIstub, cardFingerprint) {
+		return StatusConflict, "対象のカードは使用できません"
+	}
+	if ownerId := s.getCardOwnerId(APIstub, cardFingerprint); ownerId != "" && ownerId != userId {
+		return StatusConflict, "対象のカードは別のユーザーが登録しています"
+	}
+	return StatusOk, ""
+}
+
+// ユーザーが照合の失敗により操作を停止している期間中かどうか
+func (s *SmartContract) isSuspendedUser(userData UserData, now time.Time) bool {
+	if userData.SuspendedUntil == "" {
+		return false
+	}
+	lockedOutUntil, err := time.Parse(DateTimeFormat, userData.SuspendedUntil)
+	if err != nil {
+		return false
+	}
+	return now.Before(lockedOutUntil)
+}
+
+// 提示されたカードのハッシュが登録済みのものと一致するかどうか
+// 照合用のデータ導入前の登録は保存されたハッシュと直接比較する
+func (s *SmartContract) matchCard(userData UserData, cardIdmHash string) bool {
+	if cardIdmHash == "" {
+		return false
+	}
+	if userData.CardVerifier != "" {
+		return subtle.ConstantTimeCompare([]byte(s.hashCardIdm(userData.CardVerifierSalt, cardIdmHash)), []byte(userData.CardVerifier)) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(cardIdmHash), []byte(userData.CardIdmHash)) == 1
+}
+
+// 提示されたカードのハッシュを登録済みのものと照合する
+// 失敗した場合は回数を記録し、続けて失敗した場合は一定期間操作を停止する(コミットされた失敗のみ数える。MaxFailedCardAttemptsを参照)
+// 照合用のデータ導入前の登録は、照合に成功した時点で照合用のデータに置き換える(呼び出し側で返却されたユーザーデータをputすること)
+// 識別子のない登録は、照合に成功した時点で識別子を記録する(カードの差し替え・無効化に必要)
+// 失敗の記録も残すため、呼び出し側はエラーレスポンス(shim.Success)で返却すること
+func (s *SmartContract) verifyCard(APIstub shim.ChaincodeStubInterface, userData UserData, cardIdmHash string, now time.Time) (UserData, Status, string) {
+	if s.isSuspendedUser(userData, now) {
+		return userData, StatusTooManyAttempts, "カードの照合に続けて失敗したため操作を停止しています"
+	}
+
+	if !s.matchCard(userData, cardIdmHash) {
+		userData.FailedAttempts++
+		message := "カードが一致しません(残り" + strconv.Itoa(MaxFailedCardAttempts-userData.FailedAttempts) + "回)"
+		if userData.FailedAttempts >= MaxFailedCardAttempts {
+			userData.FailedAttempts = 0
+			userData.SuspendedUntil = now.Add(CardSuspendDuration).Format(DateTimeFormat)
+			message = "カードの照合に続けて失敗したため操作を停止しました"
+		}
+		s.putUserData(APIstub, userData)
+		return userData, StatusNotAllowed, message
+	}
+
+	if userData.CardVerifier == "" {
+		userData.CardVerifierSalt, userData.CardVerifier = s.makeCardVerifier(APIstub, cardIdmHash)
+		userData.CardIdmHash = ""
+	}
+	if userData.CardFingerprint == "" {
+		userData.CardFingerprint = s.makeCardFingerprint(cardIdmHash)
+		if s.getCardOwnerId(APIstub, userData.CardFingerprint) == "" {
+			APIstub.PutState(s.makeCardFingerprintKey(userData.CardFingerprint), []byte(userData.UserId))
+		}
+	}
+	userData.FailedAttempts = 0
+	userData.SuspendedUntil = ""
+	return userData, StatusOk, ""
+}
+
+// カードを再発行したものに差し替える
+// 管理者は紛失時などそのまま差し替えられる
+// 本人(ユーザーIDと同じアイデンティティ)の場合は現在のカードの照合が必要(transientデータの"card_idm_hash"で渡す)
+// 識別子のないカード(識別子の導入前に登録し、まだ照合していないもの)は無効にできないため、管理者の場合も現在のカードの照合が必要
+// 引数はユーザーID、新しいソルト
+// 新しいカードのハッシュはtransientデータの"new_card_idm_hash"で渡す
+func (s *SmartContract) replaceCard(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	userId := args[0]
+	newCardSalt := args[1]
+	newCardIdmHash := s.getCardHashFromTransient(APIstub, NewCardTransientKey)
+	cardIdmHash := s.getCardHashFromTransient(APIstub, CardTransientKey)
+	if newCardIdmHash == "" {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	newCardFingerprint := s.makeCardFingerprint(newCardIdmHash)
+
+	userData := s.getUserDataFromState(APIstub, userId)
+	if !s.isValidUserData(userData) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のユーザーが存在しません")
+	}
+
+	now := s.getTxTime(APIstub)
+	invokerId := s.getInvokerId(APIstub)
+	if invokerId != AdminUserId && (invokerId == "" || invokerId != userId) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "管理者または本人のみ実行できます")
+	}
+	if invokerId != AdminUserId || userData.CardFingerprint == "" {
+		if cardIdmHash == "" {
+			return s.makeErrorResponce(APIstub, StatusBadRequest, "現在のカードの照合が必要です")
+		}
+		var status Status
+		var message string
+		userData, status, message = s.verifyCard(APIstub, userData, cardIdmHash, now)
+		if status != StatusOk {
+			return s.makeErrorResponce(APIstub, status, message)
+		}
+	}
+
+	if newCardFingerprint == userData.CardFingerprint {
+		return s.makeErrorResponce(APIstub, StatusConflict, "対象のカードは使用できません")
+	}
+	if status, message := s.checkCardAvailable(APIstub, userId, newCardFingerprint); status != StatusOk {
+		return s.makeErrorResponce(APIstub, status, message)
+	}
+
+	// 古いカードは再登録できないよう無効にする
+	blacklisted := BlacklistedCard{
+		CardFingerprint: userData.CardFingerprint,
+		UserId:          userId,
+		BlacklistedAt:   now.Format(DateTimeFormat),
+	}
+	blacklistedAsBytes, _ := json.Marshal(blacklisted)
+	APIstub.PutState(s.makeCardBlacklistKey(blacklisted.CardFingerprint), blacklistedAsBytes)
+	APIstub.DelState(s.makeCardFingerprintKey(userData.CardFingerprint))
+
+	cardReplacement := CardReplacement{
+		TxId:               APIstub.GetTxID(),
+		UserId:             userId,
+		OldCardFingerprint: userData.CardFingerprint,
+		NewCardFingerprint: newCardFingerprint,
+		ReplacedBy:         invokerId,
+		ReplacedAt:         now.Format(DateTimeFormat),
+	}
+	cardReplacementAsBytes, _ := json.Marshal(cardReplacement)
+	indexKey, _ := APIstub.CreateCompositeKey(cardReplacementIndexName, []string{userId, cardReplacement.TxId})
+	APIstub.PutState(indexKey, cardReplacementAsBytes)
+
+	userData.CardIdmHash = ""
+	userData.CardSalt = newCardSalt
+	userData.CardFingerprint = newCardFingerprint
+	userData.CardVerifierSalt, userData.CardVerifier = s.makeCardVerifier(APIstub, newCardIdmHash)
+	APIstub.PutState(s.makeCardFingerprintKey(newCardFingerprint), []byte(userId))
+	userData.FailedAttempts = 0
+	userData.SuspendedUntil = ""
+	s.putUserData(APIstub, userData)
+
+	result := ReplaceCardResult{Status: StatusOk, UserData: s.sanitizeUserData(userData), CardReplacement: cardReplacement}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// カードの差し替え履歴を取得する(管理者、本人のみ)
+func (s *SmartContract) getCardReplacementHistory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	userId := args[0]
+
+	invokerId := s.getInvokerId(APIstub)
+	if invokerId == "" || (invokerId != AdminUserId && invokerId != userId) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "管理者または本人のみ実行できます")
+	}
+
+	indexIterator, err := APIstub.GetStateByPartialCompositeKey(cardReplacementIndexName, []string{userId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer indexIterator.Close()
+
+	cardReplacements := []CardReplacement{}
+	for indexIterator.HasNext() {
+		queryResponse, err := indexIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		cardReplacement := CardReplacement{}
+		if err := json.Unmarshal(queryResponse.Value, &cardReplacement); err != nil {
+			continue
+		}
+		cardReplacements = append(cardReplacements, cardReplacement)
+	}
+
+	sort.SliceStable(cardReplacements, func(i, j int) bool {
+		return cardReplacements[i].ReplacedAt < cardReplacements[j].ReplacedAt
+	})
+
+	result := GetCardReplacementHistoryResult{Status: StatusOk, CardReplacements: cardReplacements}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 照合の失敗による操作停止を解除する(管理者のみ)
+func (s *SmartContract) resetCardSuspension(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	if !s.isAdminInvoker(APIstub) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "管理者のみ実行できます")
+	}
+
+	userData := s.getUserDataFromState(APIstub, args[0])
+	if !s.isValidUserData(userData) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のユーザーが存在しません")
+	}
+
+	userData.FailedAttempts = 0
+	userData.SuspendedUntil = ""
+	s.putUserData(APIstub, userData)
+
+	result := ResetCardSuspensionResult{Status: StatusOk, UserData: s.sanitizeUserData(userData)}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
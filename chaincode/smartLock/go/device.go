@@ -0,0 +1,221 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 錠前端末が開封を検知した際に発行するイベント名
+const DeviceTamperedEventName = "DeviceTampered"
+
+// 錠前端末が報告した実際の状態
+// 利用者の操作(LockerData)と同じキーに書くと競合するため、ロッカー毎に別キーで持つ
+type DeviceState struct {
+	LockerId       string       `json:"locker_id"`       // "box_0001"
+	DeviceId       string       `json:"device_id"`       // "lock_device_0001"
+	ReportedStatus LockerStatus `json:"reported_status"` // "locked"
+	BatteryLevel   int          `json:"battery_level"`   // 80 (%)
+	IsTampered     bool         `json:"is_tampered"`     // false
+	ReportedAt     string       `json:"reported_at"`     // "2018-09-22 20:32:15 UTC"
+}
+
+type SetLockerDeviceResult GetLockerDataResult
+
+type GetDeviceStateResult struct {
+	Status        Status       `json:"status"`
+	LockerId      string       `json:"locker_id"`      // "box_0001"
+	DesiredStatus LockerStatus `json:"desired_status"` // "unlocked" (利用者が要求した状態)
+	DeviceState   DeviceState  `json:"device_state"`
+	IsMismatched  bool         `json:"is_mismatched"` // true
+}
+
+type GetStateMismatchesResult struct {
+	Status     Status                 `json:"status"`
+	Mismatches []GetDeviceStateResult `json:"mismatches"`
+}
+
+// DeviceState用Stateキー作成関数
+func (s *SmartContract) makeDeviceStateKey(lockerId string) string {
+	return "device_state_" + lockerId
+}
+
+// 指定ロッカーの報告済みの状態取得
+func (s *SmartContract) getDeviceStateFromState(APIstub shim.ChaincodeStubInterface, lockerId string) DeviceState {
+	deviceStateAsBytes, _ := APIstub.GetState(s.makeDeviceStateKey(lockerId))
+	deviceState := DeviceState{}
+
+	if len(deviceStateAsBytes) != 0 {
+		json.Unmarshal(deviceStateAsBytes, &deviceState)
+	}
+
+	return deviceState
+}
+
+// 要求した状態と報告された状態をまとめる
+// 報告がまだない場合は不一致としない
+func (s *SmartContract) makeDeviceStateResult(lockerData LockerData, deviceState DeviceState) GetDeviceStateResult {
+	return GetDeviceStateResult{
+		Status:        StatusOk,
+		LockerId:      lockerData.LockerId,
+		DesiredStatus: lockerData.LockerStatus,
+		DeviceState:   deviceState,
+		IsMismatched:  deviceState.ReportedStatus != "" && deviceState.ReportedStatus != lockerData.LockerStatus,
+	}
+}
+
+// ロッカーの錠前端末を設定する(ロッカーの所有者・管理者のみ)
+func (s *SmartContract) setLockerDevice(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	lockerId := args[0]
+	deviceId := args[1]
+
+	lockerData := s.getLockerDataFromState(APIstub, lockerId)
+	if !s.isValidLockerData(lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のロッカーが存在しません")
+	}
+	if !s.canManageLocker(APIstub, lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "対象のロッカーの管理権限がありません")
+	}
+
+	lockerData.DeviceId = deviceId
+	s.putLockerData(APIstub, lockerData)
+
+	result := SetLockerDeviceResult{Status: StatusOk, LockerData: lockerData}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 錠前端末から実際の状態を報告する(ロッカーに設定された端末のみ)
+// 引数はロッカーID、実際の状態、電池残量(%)、開封検知("true"/"false")
+func (s *SmartContract) reportDeviceState(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	lockerId := args[0]
+	reportedStatus := LockerStatus(args[1])
+	if reportedStatus != StatusLock && reportedStatus != StatusUnlock {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	batteryLevel, err := strconv.Atoi(args[2])
+	if err != nil || batteryLevel < 0 || batteryLevel > 100 {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	isTampered, err := strconv.ParseBool(args[3])
+	if err != nil {
+		return shim.Error("Incorrect type of arguments.")
+	}
+
+	lockerData := s.getLockerDataFromState(APIstub, lockerId)
+	if !s.isValidLockerData(lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のロッカーが存在しません")
+	}
+
+	invokerId := s.getInvokerId(APIstub)
+	if lockerData.DeviceId == "" || invokerId != lockerData.DeviceId {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "対象のロッカーの錠前端末ではありません")
+	}
+
+	deviceState := DeviceState{
+		LockerId:       lockerId,
+		DeviceId:       invokerId,
+		ReportedStatus: reportedStatus,
+		BatteryLevel:   batteryLevel,
+		IsTampered:     isTampered,
+		ReportedAt:     s.getTxTime(APIstub).Format(DateTimeFormat),
+	}
+	deviceStateAsBytes, _ := json.Marshal(deviceState)
+	APIstub.PutState(s.makeDeviceStateKey(lockerId), deviceStateAsBytes)
+
+	// 開封を検知した場合は監視側でアラートを出せるようイベントを発行する
+	if isTampered {
+		if err := APIstub.SetEvent(DeviceTamperedEventName, deviceStateAsBytes); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	result := s.makeDeviceStateResult(lockerData, deviceState)
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 指定ロッカーの要求した状態と報告された状態を取得する
+func (s *SmartContract) getDeviceState(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	lockerData := s.getLockerDataFromState(APIstub, args[0])
+	if !s.isValidLockerData(lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のロッカーが存在しません")
+	}
+
+	result := s.makeDeviceStateResult(lockerData, s.getDeviceStateFromState(APIstub, lockerData.LockerId))
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 要求した状態と報告された状態が一致しないロッカーの一覧を取得する
+func (s *SmartContract) getStateMismatches(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	lockerIterator, err := APIstub.GetStateByRange(s.makeLockerDataKey(""), s.makeLockerDataKey(string(utf8.MaxRune)))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer lockerIterator.Close()
+
+	result := GetStateMismatchesResult{Status: StatusOk, Mismatches: []GetDeviceStateResult{}}
+	for lockerIterator.HasNext() {
+		queryResponse, err := lockerIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		lockerData := LockerData{}
+		if err := json.Unmarshal(queryResponse.Value, &lockerData); err != nil || !s.isValidLockerData(lockerData) {
+			continue
+		}
+		deviceStateResult := s.makeDeviceStateResult(lockerData, s.getDeviceStateFromState(APIstub, lockerData.LockerId))
+		if deviceStateResult.IsMismatched {
+			result.Mismatches = append(result.Mismatches, deviceStateResult)
+		}
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+	return shim.Success(resultAsBytes)
+}
@@ -0,0 +1,391 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+type UserGroup struct {
+	GroupId   string   `json:"group_id"`   // "team_dev"
+	Name      string   `json:"name"`       // "開発チーム"
+	ManagerId string   `json:"manager_id"` // "dev_manager" (メンバーを管理できるFabricアイデンティティ)
+	MemberIds []string `json:"member_ids"` // ["kohun_0001"]
+	LockerIds []string `json:"locker_ids"` // ["box_0001"] (グループに開錠権限を付与したロッカー)
+}
+
+type UserGroupResult struct {
+	Status    Status    `json:"status"`
+	UserGroup UserGroup `json:"user_group"`
+}
+
+type GiveGroupLockerPermissionResult struct {
+	Status     Status           `json:"status"`
+	GroupId    string           `json:"group_id"`
+	Permission LockerPermission `json:"permission"`
+}
+type RevokeGroupLockerPermissionResult GiveGroupLockerPermissionResult
+
+// ユーザー毎に展開した実際の権限
+type EffectivePermission struct {
+	UserId     string          `json:"user_id"`            // "kohun_0001"
+	GroupId    string          `json:"group_id,omitempty"` // "team_dev" (グループ経由の場合のみ)
+	ValidFrom  string          `json:"valid_from"`         // "2018-09-22 09:00:00 UTC"
+	ValidUntil string          `json:"valid_until"`        // "2018-09-29 18:00:00 UTC"
+	Schedule   *AccessSchedule `json:"schedule,omitempty"` // 曜日・時間帯の制限(なければ常時)
+	IsActive   bool            `json:"is_active"`          // true (現在開錠に使えるかどうか)
+}
+
+type GetEffectivePermissionsResult struct {
+	Status      Status                `json:"status"`
+	LockerId    string                `json:"locker_id"`
+	Permissions []EffectivePermission `json:"permissions"`
+}
+
+// UserGroup用Stateキー作成関数
+func (s *SmartContract) makeUserGroupKey(groupId string) string {
+	return "group_" + groupId
+}
+
+// 指定グループのデータ取得
+func (s *SmartContract) getUserGroupFromState(APIstub shim.ChaincodeStubInterface, groupId string) UserGroup {
+	userGroupAsBytes, _ := APIstub.GetState(s.makeUserGroupKey(groupId))
+	userGroup := UserGroup{}
+
+	if len(userGroupAsBytes) != 0 {
+		json.Unmarshal(userGroupAsBytes, &userGroup)
+	}
+	if userGroup.MemberIds == nil {
+		userGroup.MemberIds = []string{}
+	}
+
+	return userGroup
+}
+
+// グループデータput
+func (s *SmartContract) putUserGroup(APIstub shim.ChaincodeStubInterface, userGroup UserGroup) {
+	userGroupAsBytes, _ := json.Marshal(userGroup)
+	APIstub.PutState(s.makeUserGroupKey(userGroup.GroupId), userGroupAsBytes)
+}
+
+// ユーザーがグループのメンバーかどうか
+func (s *SmartContract) isGroupMember(userGroup UserGroup, userId string) bool {
+	for _, memberId := range userGroup.MemberIds {
+		if memberId == userId {
+			return true
+		}
+	}
+	return false
+}
+
+// 呼び出し元がグループのメンバーを管理できるかどうか
+// メンバーの変更はグループに付与したロッカーの開錠権限の変更になるため、
+// グループの管理者はグループに権限を付与したロッカーをすべて管理できる場合のみ変更できる
+func (s *SmartContract) canManageUserGroup(APIstub shim.ChaincodeStubInterface, userGroup UserGroup) bool {
+	invokerId := s.getInvokerId(APIstub)
+	if invokerId == "" {
+		return false
+	}
+	if invokerId == AdminUserId {
+		return true
+	}
+	if invokerId != userGroup.ManagerId {
+		return false
+	}
+
+	for _, lockerId := range userGroup.LockerIds {
+		lockerData := s.getLockerDataFromState(APIstub, lockerId)
+		if !s.isValidLockerData(lockerData) || s.findGroupLockerPermission(lockerData, userGroup.GroupId) < 0 {
+			continue
+		}
+		if !s.canManageLocker(APIstub, lockerData) {
+			return false
+		}
+	}
+	return true
+}
+
+// グループに権限を付与したロッカーを記録する
+func (s *SmartContract) addUserGroupLocker(userGroup UserGroup, lockerId string) UserGroup {
+	for _, id := range userGroup.LockerIds {
+		if id == lockerId {
+			return userGroup
+		}
+	}
+	userGroup.LockerIds = append(userGroup.LockerIds, lockerId)
+	return userGroup
+}
+
+// グループに権限を付与したロッカーの記録を削除する
+func (s *SmartContract) removeUserGroupLocker(userGroup UserGroup, lockerId string) UserGroup {
+	lockerIds := []string{}
+	for _, id := range userGroup.LockerIds {
+		if id != lockerId {
+			lockerIds = append(lockerIds, id)
+		}
+	}
+	userGroup.LockerIds = lockerIds
+	return userGroup
+}
+
+func (s *SmartContract) makeUserGroupResult(userGroup UserGroup) sc.Response {
+	result := UserGroupResult{Status: StatusOk, UserGroup: userGroup}
+	resultAsBytes, _ := json.Marshal(result)
+	return shim.Success(resultAsBytes)
+}
+
+// グループを作成する(管理者のみ)
+// 3つ目の引数でメンバーを管理できるアイデンティティを指定できる
+func (s *SmartContract) createUserGroup(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or 3")
+	}
+
+	userGroup := UserGroup{
+		GroupId:   args[0],
+		Name:      args[1],
+		MemberIds: []string{},
+		LockerIds: []string{},
+	}
+	if len(args) == 3 {
+		userGroup.ManagerId = args[2]
+	}
+	if userGroup.GroupId == "" {
+		return shim.Error("Incorrect type of arguments.")
+	}
+
+	if !s.isAdminInvoker(APIstub) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "管理者のみ実行できます")
+	}
+	if s.getUserGroupFromState(APIstub, userGroup.GroupId).GroupId != "" {
+		return s.makeErrorResponce(APIstub, StatusConflict, "対象のグループIDのデータが存在しています")
+	}
+
+	s.putUserGroup(APIstub, userGroup)
+
+	return s.makeUserGroupResult(userGroup)
+}
+
+// グループにメンバーを追加する(管理者、グループの管理者のみ)
+// グループの管理者は、グループに権限を付与したロッカーをすべて管理できる場合のみ追加できる
+func (s *SmartContract) addUserGroupMember(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	groupId := args[0]
+	userId := args[1]
+
+	userGroup := s.getUserGroupFromState(APIstub, groupId)
+	if userGroup.GroupId == "" {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のグループが存在しません")
+	}
+	if !s.isValidUserData(s.getUserDataFromState(APIstub, userId)) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のユーザーが存在しません")
+	}
+	if !s.canManageUserGroup(APIstub, userGroup) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "対象のグループの管理権限がありません")
+	}
+	if s.isGroupMember(userGroup, userId) {
+		return s.makeErrorResponce(APIstub, StatusConflict, "すでにグループのメンバーです")
+	}
+
+	userGroup.MemberIds = append(userGroup.MemberIds, userId)
+	s.putUserGroup(APIstub, userGroup)
+
+	return s.makeUserGroupResult(userGroup)
+}
+
+// グループからメンバーを削除する(管理者、グループの管理者のみ)
+// グループの管理者は、グループに権限を付与したロッカーをすべて管理できる場合のみ削除できる
+func (s *SmartContract) removeUserGroupMember(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	groupId := args[0]
+	userId := args[1]
+
+	userGroup := s.getUserGroupFromState(APIstub, groupId)
+	if userGroup.GroupId == "" {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のグループが存在しません")
+	}
+	if !s.canManageUserGroup(APIstub, userGroup) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "対象のグループの管理権限がありません")
+	}
+	if !s.isGroupMember(userGroup, userId) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "グループのメンバーではありません")
+	}
+
+	memberIds := []string{}
+	for _, memberId := range userGroup.MemberIds {
+		if memberId != userId {
+			memberIds = append(memberIds, memberId)
+		}
+	}
+	userGroup.MemberIds = memberIds
+	s.putUserGroup(APIstub, userGroup)
+
+	return s.makeUserGroupResult(userGroup)
+}
+
+func (s *SmartContract) getUserGroup(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	userGroup := s.getUserGroupFromState(APIstub, args[0])
+
+	result := UserGroupResult{Status: StatusOk, UserGroup: userGroup}
+	if userGroup.GroupId == "" {
+		result.Status = StatusNotFound
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+	return shim.Success(resultAsBytes)
+}
+
+// ロッカーに対して操作可能なグループを追加する(ロッカーの所有者・管理者のみ)
+// 3つ目、4つ目の引数で有効期間の開始・終了を指定できる(空文字は無期限)
+// すでに権限があるグループの場合は有効期間を更新する
+func (s *SmartContract) giveGroupLockerPermission(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or 4")
+	}
+
+	groupId := args[0]
+	lockerId := args[1]
+
+	permission := LockerPermission{GroupId: groupId}
+	if len(args) == 4 {
+		var status Status
+		var message string
+		permission, status, message = s.parsePermissionTerm(permission, args[2], args[3])
+		if status != StatusOk {
+			return s.makeErrorResponce(APIstub, status, message)
+		}
+	}
+
+	lockerData := s.getLockerDataFromState(APIstub, lockerId)
+	if !s.isValidLockerData(lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のロッカーが存在しません")
+	}
+	userGroup := s.getUserGroupFromState(APIstub, groupId)
+	if userGroup.GroupId == "" {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のグループが存在しません")
+	}
+	if !s.canManageLocker(APIstub, lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "対象のロッカーの管理権限がありません")
+	}
+
+	// 曜日・時間帯の制限は引き継ぐ
+	if index := s.findGroupLockerPermission(lockerData, groupId); index >= 0 {
+		permission.Schedule = lockerData.Permissions[index].Schedule
+		lockerData.Permissions[index] = permission
+	} else {
+		lockerData.Permissions = append(lockerData.Permissions, permission)
+	}
+	s.putLockerData(APIstub, lockerData)
+	s.putUserGroup(APIstub, s.addUserGroupLocker(userGroup, lockerId))
+
+	result := GiveGroupLockerPermissionResult{Status: StatusOk, GroupId: groupId, Permission: permission}
+	resultAsBytes, _ := json.Marshal(result)
+	return shim.Success(resultAsBytes)
+}
+
+// ロッカーに対して操作可能なグループを削除する(ロッカーの所有者・管理者のみ)
+func (s *SmartContract) revokeGroupLockerPermission(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	groupId := args[0]
+	lockerId := args[1]
+
+	lockerData := s.getLockerDataFromState(APIstub, lockerId)
+	if !s.isValidLockerData(lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のロッカーが存在しません")
+	}
+	if !s.canManageLocker(APIstub, lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "対象のロッカーの管理権限がありません")
+	}
+
+	index := s.findGroupLockerPermission(lockerData, groupId)
+	if index < 0 {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のグループに権限がありません")
+	}
+
+	permission := lockerData.Permissions[index]
+	lockerData.Permissions = append(lockerData.Permissions[:index], lockerData.Permissions[index+1:]...)
+	s.putLockerData(APIstub, lockerData)
+	if userGroup := s.getUserGroupFromState(APIstub, groupId); userGroup.GroupId != "" {
+		s.putUserGroup(APIstub, s.removeUserGroupLocker(userGroup, lockerId))
+	}
+
+	result := RevokeGroupLockerPermissionResult{Status: StatusOk, GroupId: groupId, Permission: permission}
+	resultAsBytes, _ := json.Marshal(result)
+	return shim.Success(resultAsBytes)
+}
+
+// ロッカーを操作できるユーザーを、グループをメンバーに展開して一覧にする
+func (s *SmartContract) getEffectivePermissions(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	lockerData := s.getLockerDataFromState(APIstub, args[0])
+	if !s.isValidLockerData(lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のロッカーが存在しません")
+	}
+
+	now := s.getTxTime(APIstub)
+	result := GetEffectivePermissionsResult{Status: StatusOk, LockerId: lockerData.LockerId, Permissions: []EffectivePermission{}}
+	for _, permission := range lockerData.Permissions {
+		isActive := s.isActiveLockerPermission(permission, now)
+
+		userIds := []string{permission.UserId}
+		if permission.GroupId != "" {
+			userIds = s.getUserGroupFromState(APIstub, permission.GroupId).MemberIds
+		}
+		for _, userId := range userIds {
+			result.Permissions = append(result.Permissions, EffectivePermission{
+				UserId:     userId,
+				GroupId:    permission.GroupId,
+				ValidFrom:  permission.ValidFrom,
+				ValidUntil: permission.ValidUntil,
+				Schedule:   permission.Schedule,
+				IsActive:   isActive,
+			})
+		}
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+	return shim.Success(resultAsBytes)
+}
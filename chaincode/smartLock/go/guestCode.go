@@ -0,0 +1,393 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ゲストコードを渡すtransientデータのキー
+// コードそのものを台帳に残さないよう、引数ではなくtransientデータで受け取る
+const GuestCodeTransientKey = "code"
+
+// ゲストコードで操作した場合のLastChangeStatusUserIdの接頭辞
+const GuestUserIdPrefix = "guest:"
+
+// ゲストコードの照合に続けて失敗できる回数(超えたら無効にする)
+const MaxFailedGuestCodeAttempts = 5
+
+// ゲストコードに含むべき乱数の最小バイト数(128ビット)
+// ハッシュとソルトは台帳から読めるため、総当たりで復元できないよう、
+// 発行側で暗号論的乱数から生成し16進数またはBase64で表したコードのみ受け付ける
+const MinGuestCodeBytes = 16
+
+const guestCodeIndexName = "guest_code~locker"
+
+type GuestCode struct {
+	CodeId         string `json:"code_id"`             // "e3b0c442..."(発行時のTxID)
+	LockerId       string `json:"locker_id"`           // "box_0001"
+	CodeHash       string `json:"code_hash,omitempty"` // "9f86d081..." (ソルト付きのSHA-256)
+	Salt           string `json:"salt,omitempty"`      // "5feceb66..."
+	ExpiresAt      string `json:"expires_at"`          // "2018-09-23 18:00:00 UTC"
+	MaxUses        int    `json:"max_uses"`            // 2 (開錠できる回数)
+	UseCount       int    `json:"use_count"`           // 0 (開錠した回数)
+	FailedAttempts int    `json:"failed_attempts"`     // 0
+	IsRevoked      bool   `json:"is_revoked"`          // false
+	IssuedBy       string `json:"issued_by"`           // "floor_manager_3f"
+	IssuedAt       string `json:"issued_at"`           // "2018-09-22 20:32:11 UTC"
+}
+
+type GuestCodeResult struct {
+	Status    Status    `json:"status"`
+	GuestCode GuestCode `json:"guest_code"`
+}
+
+type GuestCodesResult struct {
+	Status     Status      `json:"status"`
+	GuestCodes []GuestCode `json:"guest_codes"`
+}
+
+// GuestCode用Stateキー作成関数
+func (s *SmartContract) makeGuestCodeKey(codeId string) string {
+	return "guest_code_" + codeId
+}
+
+// 指定IDのゲストコード取得
+func (s *SmartContract) getGuestCodeFromState(APIstub shim.ChaincodeStubInterface, codeId string) GuestCode {
+	guestCodeAsBytes, _ := APIstub.GetState(s.makeGuestCodeKey(codeId))
+	guestCode := GuestCode{}
+
+	if len(guestCodeAsBytes) != 0 {
+		json.Unmarshal(guestCodeAsBytes, &guestCode)
+	}
+
+	return guestCode
+}
+
+// ゲストコードput
+// 使用できるものだけロッカー毎のインデックスに載せる
+func (s *SmartContract) putGuestCode(APIstub shim.ChaincodeStubInterface, guestCode GuestCode, now time.Time) {
+	guestCodeAsBytes, _ := json.Marshal(guestCode)
+	APIstub.PutState(s.makeGuestCodeKey(guestCode.CodeId), guestCodeAsBytes)
+
+	indexKey, _ := APIstub.CreateCompositeKey(guestCodeIndexName, []string{guestCode.LockerId, guestCode.CodeId})
+	if s.isUsableGuestCode(guestCode, now) {
+		APIstub.PutState(indexKey, []byte{0x00})
+	} else {
+		APIstub.DelState(indexKey)
+	}
+}
+
+// ゲストコードのハッシュを計算する
+func (s *SmartContract) hashGuestCode(salt string, code []byte) string {
+	hash := sha256.Sum256(append([]byte(salt), code...))
+	return hex.EncodeToString(hash[:])
+}
+
+// transientデータからゲストコードを取得する
+func (s *SmartContract) getGuestCodeFromTransient(APIstub shim.ChaincodeStubInterface) []byte {
+	transient, err := APIstub.GetTransient()
+	if err != nil {
+		return nil
+	}
+	return transient[GuestCodeTransientKey]
+}
+
+// 16進数またはBase64で表したゲストコードを元のバイト列に戻す
+func (s *SmartContract) decodeGuestCode(code []byte) ([]byte, bool) {
+	if decoded, err := hex.DecodeString(string(code)); err == nil {
+		return decoded, true
+	}
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if decoded, err := encoding.DecodeString(string(code)); err == nil {
+			return decoded, true
+		}
+	}
+	return nil, false
+}
+
+// 必要なバイト数の乱数を表したゲストコードかどうか
+func (s *SmartContract) isStrongGuestCode(code []byte) bool {
+	decoded, ok := s.decodeGuestCode(code)
+	return ok && len(decoded) >= MinGuestCodeBytes
+}
+
+// レスポンス用にゲストコードのハッシュとソルトを取り除く
+func (s *SmartContract) sanitizeGuestCodes(guestCodes []GuestCode) []GuestCode {
+	result := []GuestCode{}
+	for _, guestCode := range guestCodes {
+		guestCode.CodeHash = ""
+		guestCode.Salt = ""
+		result = append(result, guestCode)
+	}
+	return result
+}
+
+// ゲストコードが無効にされておらず有効期限内かどうか
+// 使用回数は開錠のみ数えるため、使い切ったコードでもこの間は施錠できる
+func (s *SmartContract) isUnexpiredGuestCode(guestCode GuestCode, now time.Time) bool {
+	if guestCode.CodeId == "" || guestCode.IsRevoked {
+		return false
+	}
+	expiresAt, err := time.Parse(DateTimeFormat, guestCode.ExpiresAt)
+	if err != nil {
+		return false
+	}
+	return now.Before(expiresAt)
+}
+
+// ゲストコードで開錠できるかどうか
+func (s *SmartContract) isUsableGuestCode(guestCode GuestCode, now time.Time) bool {
+	return s.isUnexpiredGuestCode(guestCode, now) && guestCode.UseCount < guestCode.MaxUses
+}
+
+// 指定ロッカーの使用できるゲストコードの一覧取得
+func (s *SmartContract) getOutstandingGuestCodes(APIstub shim.ChaincodeStubInterface, lockerId string, now time.Time) ([]GuestCode, error) {
+	guestCodes := []GuestCode{}
+
+	indexIterator, err := APIstub.GetStateByPartialCompositeKey(guestCodeIndexName, []string{lockerId})
+	if err != nil {
+		return nil, err
+	}
+	defer indexIterator.Close()
+
+	for indexIterator.HasNext() {
+		queryResponse, err := indexIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keyParts, err := APIstub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(keyParts) != 2 {
+			continue
+		}
+		guestCode := s.getGuestCodeFromState(APIstub, keyParts[1])
+		if s.isUsableGuestCode(guestCode, now) {
+			guestCodes = append(guestCodes, guestCode)
+		}
+	}
+
+	return guestCodes, nil
+}
+
+// ゲストコードを発行する(ロッカーの所有者・管理者のみ)
+// 引数はロッカーID、有効期限、最大使用回数(開錠できる回数)。コードはtransientデータの"code"で渡す
+// コードは16バイト以上の暗号論的乱数を16進数またはBase64で表したものとすること(照合時も同じ表記で渡す)
+func (s *SmartContract) issueGuestCode(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	lockerId := args[0]
+	expiresAt, err := time.Parse(DateTimeFormat, args[1])
+	if err != nil {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	maxUses, err := strconv.Atoi(args[2])
+	if err != nil || maxUses <= 0 {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	code := s.getGuestCodeFromTransient(APIstub)
+	if len(code) == 0 {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "ゲストコードが指定されていません")
+	}
+	if !s.isStrongGuestCode(code) {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "ゲストコードは"+strconv.Itoa(MinGuestCodeBytes)+"バイト以上の乱数を16進数またはBase64で表したものを指定してください")
+	}
+
+	now := s.getTxTime(APIstub)
+	if !expiresAt.After(now) {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "有効期限が過去の日時です")
+	}
+
+	lockerData := s.getLockerDataFromState(APIstub, lockerId)
+	if !s.isValidLockerData(lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のロッカーが存在しません")
+	}
+	if !s.canManageLocker(APIstub, lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "対象のロッカーの管理権限がありません")
+	}
+
+	// ソルトはTxIDから作る(endorserごとに同じ値になるように)
+	saltHash := sha256.Sum256([]byte(APIstub.GetTxID()))
+	salt := hex.EncodeToString(saltHash[:16])
+
+	guestCode := GuestCode{
+		CodeId:    APIstub.GetTxID(),
+		LockerId:  lockerId,
+		CodeHash:  s.hashGuestCode(salt, code),
+		Salt:      salt,
+		ExpiresAt: expiresAt.UTC().Format(DateTimeFormat),
+		MaxUses:   maxUses,
+		IssuedBy:  s.getInvokerId(APIstub),
+		IssuedAt:  now.Format(DateTimeFormat),
+	}
+	s.putGuestCode(APIstub, guestCode, now)
+
+	result := GuestCodeResult{Status: StatusOk, GuestCode: s.sanitizeGuestCodes([]GuestCode{guestCode})[0]}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 使用できるゲストコードを無効にする(ロッカーの所有者・管理者のみ)
+// 2つ目の引数でコードIDを指定した場合はそのコードのみ、省略した場合はロッカーの全コードが対象
+func (s *SmartContract) revokeGuestCodes(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+
+	lockerId := args[0]
+	now := s.getTxTime(APIstub)
+
+	lockerData := s.getLockerDataFromState(APIstub, lockerId)
+	if lockerData.LockerId == "" {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のロッカーが存在しません")
+	}
+	if !s.canManageLocker(APIstub, lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "対象のロッカーの管理権限がありません")
+	}
+
+	guestCodes, err := s.getOutstandingGuestCodes(APIstub, lockerId, now)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	revoked := []GuestCode{}
+	for _, guestCode := range guestCodes {
+		if len(args) == 2 && guestCode.CodeId != args[1] {
+			continue
+		}
+		guestCode.IsRevoked = true
+		s.putGuestCode(APIstub, guestCode, now)
+		revoked = append(revoked, guestCode)
+	}
+	if len(args) == 2 && len(revoked) < 1 {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "使用できるゲストコードが見つかりませんでした")
+	}
+
+	result := GuestCodesResult{Status: StatusOk, GuestCodes: s.sanitizeGuestCodes(revoked)}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 指定ロッカーの使用できるゲストコードの一覧を取得する(ロッカーの所有者・管理者のみ)
+func (s *SmartContract) getGuestCodes(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	lockerData := s.getLockerDataFromState(APIstub, args[0])
+	if lockerData.LockerId == "" {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のロッカーが存在しません")
+	}
+	if !s.canManageLocker(APIstub, lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "対象のロッカーの管理権限がありません")
+	}
+
+	guestCodes, err := s.getOutstandingGuestCodes(APIstub, lockerData.LockerId, s.getTxTime(APIstub))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result := GuestCodesResult{Status: StatusOk, GuestCodes: s.sanitizeGuestCodes(guestCodes)}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// ゲストコードでロッカーを開閉する
+// 引数はロッカーID、コードID、変更後のステータス。コードはtransientデータの"code"で渡す
+// 使用回数は開錠のみ数え、施錠は有効期限内であれば回数によらずできる
+func (s *SmartContract) changeLockerStatusWithCode(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	lockerId := args[0]
+	codeId := args[1]
+	toStatus := LockerStatus(args[2])
+	code := s.getGuestCodeFromTransient(APIstub)
+
+	lockerData := s.getLockerDataFromState(APIstub, lockerId)
+	guestCode := s.getGuestCodeFromState(APIstub, codeId)
+	now := s.getTxTime(APIstub)
+
+	// 拒否した場合もアクセスログに記録する
+	accessEvent := s.makeAccessEvent(APIstub, "", lockerId, toStatus, now)
+	accessEvent.GuestCodeId = codeId
+
+	if !s.isValidLockerData(lockerData) {
+		return s.denyAccess(APIstub, accessEvent, StatusNotFound, "対象のロッカーが存在しません")
+	}
+	usable := s.isUsableGuestCode(guestCode, now)
+	if toStatus == StatusLock {
+		usable = s.isUnexpiredGuestCode(guestCode, now)
+	}
+	if guestCode.LockerId != lockerId || !usable {
+		return s.denyAccess(APIstub, accessEvent, StatusNotAllowed, "ゲストコードが無効です")
+	}
+
+	// 照合に続けて失敗したコードは無効にする
+	if subtle.ConstantTimeCompare([]byte(s.hashGuestCode(guestCode.Salt, code)), []byte(guestCode.CodeHash)) != 1 {
+		guestCode.FailedAttempts++
+		if guestCode.FailedAttempts >= MaxFailedGuestCodeAttempts {
+			guestCode.IsRevoked = true
+		}
+		s.putGuestCode(APIstub, guestCode, now)
+		return s.denyAccess(APIstub, accessEvent, StatusNotAllowed, "ゲストコードが一致しません")
+	}
+
+	//ロッカーの開閉ができるかどうか
+	if !s.canChangeLockerStatus(lockerData, toStatus) {
+		return s.denyAccess(APIstub, accessEvent, StatusConflict, "対象のロッカーの開閉ができませんでした")
+	}
+
+	if toStatus != StatusLock {
+		guestCode.UseCount++
+	}
+	guestCode.FailedAttempts = 0
+	s.putGuestCode(APIstub, guestCode, now)
+
+	lockerData.LockerStatus = toStatus
+	lockerData.LastChangeStatusUserId = GuestUserIdPrefix + codeId
+	lockerData.LastChangeStatusTime = now.Format(DateTimeFormat)
+	lockerData.RelockedBy = ""
+	s.putLockerData(APIstub, lockerData)
+	s.grantAccess(APIstub, accessEvent)
+
+	result := ChangeLockerStatusResult{Status: StatusOk, LockerData: lockerData}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
@@ -0,0 +1,157 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// listLockersで1度に取得できる最大件数
+const MaxListLockersPageSize = 100
+
+type RegisterLockerResult GetLockerDataResult
+type DecommissionLockerResult GetLockerDataResult
+
+type ListLockersResult struct {
+	Status     Status       `json:"status"`
+	LockerData []LockerData `json:"locker_data"`
+	Bookmark   string       `json:"bookmark"` // "box_0101" (次のページの先頭、最後のページなら空)
+}
+
+// ロッカーを登録する(管理者のみ)
+// 引数はロッカーID、設置場所、サイズ、所有者
+func (s *SmartContract) registerLocker(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	lockerId := args[0]
+	if lockerId == "" {
+		return shim.Error("Incorrect type of arguments.")
+	}
+
+	if !s.isAdminInvoker(APIstub) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "管理者のみ実行できます")
+	}
+
+	// 廃止済みのロッカーIDも再利用できない
+	if s.getLockerDataFromState(APIstub, lockerId).LockerId != "" {
+		return s.makeErrorResponce(APIstub, StatusConflict, "対象のロッカーIDのデータが存在しています")
+	}
+
+	lockerData := s.makeEmptyLockerData(lockerId, s.getTxTime(APIstub))
+	lockerData.Location = args[1]
+	lockerData.Size = args[2]
+	lockerData.OwnerId = args[3]
+	s.putLockerData(APIstub, lockerData)
+
+	result := RegisterLockerResult{Status: StatusOk, LockerData: lockerData}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// ロッカーを廃止する(管理者、所有者のみ)
+// 施錠中のロッカーのみ廃止でき、廃止後は権限の付与や開閉ができなくなる
+func (s *SmartContract) decommissionLocker(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	lockerData := s.getLockerDataFromState(APIstub, args[0])
+	if !s.isValidLockerData(lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のロッカーが存在しません")
+	}
+	if !s.isLockerOwnerInvoker(APIstub, lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "対象のロッカーの所有者ではありません")
+	}
+	if lockerData.LockerStatus != StatusLock {
+		return s.makeErrorResponce(APIstub, StatusConflict, "開錠中のロッカーは廃止できません")
+	}
+
+	lockerData.IsDecommissioned = true
+	lockerData.DecommissionedAt = s.getTxTime(APIstub).Format(DateTimeFormat)
+	s.putLockerData(APIstub, lockerData)
+
+	result := DecommissionLockerResult{Status: StatusOk, LockerData: lockerData}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// ロッカーの一覧をロッカーID順に取得する
+// 引数は取得件数、ブックマーク(前回の結果のbookmark、初回は空)、廃止済みを含めるか("true"/"false"、省略時は含めない)
+func (s *SmartContract) listLockers(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or 3")
+	}
+
+	pageSize, err := strconv.Atoi(args[0])
+	if err != nil || pageSize <= 0 || pageSize > MaxListLockersPageSize {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	bookmark := args[1]
+	includeDecommissioned := false
+	if len(args) == 3 {
+		includeDecommissioned, err = strconv.ParseBool(args[2])
+		if err != nil {
+			return shim.Error("Incorrect type of arguments.")
+		}
+	}
+
+	lockerIterator, err := APIstub.GetStateByRange(s.makeLockerDataKey(bookmark), s.makeLockerDataKey(string(utf8.MaxRune)))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer lockerIterator.Close()
+
+	result := ListLockersResult{Status: StatusOk, LockerData: []LockerData{}}
+	for lockerIterator.HasNext() {
+		queryResponse, err := lockerIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		lockerData := LockerData{}
+		if err := json.Unmarshal(queryResponse.Value, &lockerData); err != nil || lockerData.LockerId == "" {
+			continue
+		}
+		if lockerData.IsDecommissioned && !includeDecommissioned {
+			continue
+		}
+
+		// 1件多く読めたら次のページがある
+		if len(result.LockerData) == pageSize {
+			result.Bookmark = lockerData.LockerId
+			break
+		}
+		result.LockerData = append(result.LockerData, s.normalizeLockerPermissions(lockerData))
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+	return shim.Success(resultAsBytes)
+}
@@ -0,0 +1,170 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// マスター権限で開錠した際に発行するイベント名
+const MasterOverrideEventName = "MasterOverride"
+
+type SetMasterOverrideRoleResult struct {
+	Status   Status `json:"status"`
+	Identity string `json:"identity"` // "facility_staff_01"
+	Enabled  bool   `json:"enabled"`  // true
+}
+
+// マスター権限を持つアイデンティティ用Stateキー作成関数
+func (s *SmartContract) makeMasterOverrideKey(identity string) string {
+	return "master_override_" + identity
+}
+
+// 呼び出し元がマスター権限を持つかどうか
+func (s *SmartContract) isMasterOverrideInvoker(APIstub shim.ChaincodeStubInterface) bool {
+	invokerId := s.getInvokerId(APIstub)
+	if invokerId == "" {
+		return false
+	}
+	if invokerId == AdminUserId {
+		return true
+	}
+	roleAsBytes, _ := APIstub.GetState(s.makeMasterOverrideKey(invokerId))
+	return len(roleAsBytes) != 0
+}
+
+// マスター権限を付与・解除する(管理者のみ)
+func (s *SmartContract) setMasterOverrideRole(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	identity := args[0]
+	enabled, err := strconv.ParseBool(args[1])
+	if err != nil || identity == "" {
+		return shim.Error("Incorrect type of arguments.")
+	}
+
+	if !s.isAdminInvoker(APIstub) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "管理者のみ実行できます")
+	}
+
+	if enabled {
+		APIstub.PutState(s.makeMasterOverrideKey(identity), []byte{0x00})
+	} else {
+		APIstub.DelState(s.makeMasterOverrideKey(identity))
+	}
+
+	result := SetMasterOverrideRoleResult{Status: StatusOk, Identity: identity, Enabled: enabled}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// マスター権限で開錠する
+// 権限の有無に関わらず開錠できるが、理由の記入が必須で、アラートのイベントを発行する
+func (s *SmartContract) overrideUnlock(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	lockerId := args[0]
+	justification := strings.TrimSpace(args[1])
+
+	lockerData := s.getLockerDataFromState(APIstub, lockerId)
+	now := s.getTxTime(APIstub)
+
+	// 拒否した場合もアクセスログに記録する
+	accessEvent := s.makeAccessEvent(APIstub, "", lockerId, StatusUnlock, now)
+	accessEvent.IsOverride = true
+	accessEvent.Justification = justification
+
+	if !s.isMasterOverrideInvoker(APIstub) {
+		return s.denyAccess(APIstub, accessEvent, StatusNotAllowed, "マスター権限がありません")
+	}
+	if justification == "" {
+		return s.denyAccess(APIstub, accessEvent, StatusBadRequest, "理由の記入が必要です")
+	}
+	if !s.isValidLockerData(lockerData) {
+		return s.denyAccess(APIstub, accessEvent, StatusNotFound, "対象のロッカーが存在しません")
+	}
+	if !s.canChangeLockerStatus(lockerData, StatusUnlock) {
+		return s.denyAccess(APIstub, accessEvent, StatusConflict, "対象のロッカーの開閉ができませんでした")
+	}
+
+	lockerData.LockerStatus = StatusUnlock
+	lockerData.LastChangeStatusUserId = accessEvent.InvokerId
+	lockerData.LastChangeStatusTime = now.Format(DateTimeFormat)
+	lockerData.RelockedBy = ""
+	s.putLockerData(APIstub, lockerData)
+	s.grantAccess(APIstub, accessEvent)
+
+	// 監視側でアラートを出せるようイベントを発行する
+	accessEvent.Outcome = AccessOutcomeGranted
+	accessEvent.Status = StatusOk
+	eventAsBytes, _ := json.Marshal(accessEvent)
+	if err := APIstub.SetEvent(MasterOverrideEventName, eventAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result := ChangeLockerStatusResult{Status: StatusOk, LockerData: lockerData}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// マスター権限での開錠の記録を期間を指定して取得する(管理者のみ)
+// 引数は期間の開始、終了
+func (s *SmartContract) getOverrideLog(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	from, until, ok := s.parseAccessLogPeriod(args[0], args[1])
+	if !ok {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	if !until.After(from) || until.Sub(from) > MaxAccessLogDays*24*time.Hour {
+		return s.makeErrorResponce(APIstub, StatusBadRequest, "検索期間が不正です")
+	}
+
+	if !s.isAdminInvoker(APIstub) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "管理者のみ実行できます")
+	}
+
+	accessEvents, err := s.getAccessEvents(APIstub, accessLogOverrideIndexName, []string{}, from, until)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result := GetAccessLogResult{Status: StatusOk, AccessEvents: accessEvents}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
@@ -0,0 +1,167 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+type LockerAdministratorsResult struct {
+	Status           Status   `json:"status"`
+	LockerId         string   `json:"locker_id"`         // "box_0001"
+	OwnerId          string   `json:"owner_id"`          // "facility_manager"
+	AdministratorIds []string `json:"administrator_ids"` // ["floor_manager_3f"]
+}
+
+// 呼び出し元がロッカーを管理できるかどうか
+// 全体の管理者、ロッカーの所有者、ロッカーの管理者のみ管理できる
+func (s *SmartContract) canManageLocker(APIstub shim.ChaincodeStubInterface, lockerData LockerData) bool {
+	invokerId := s.getInvokerId(APIstub)
+	if invokerId == "" {
+		return false
+	}
+	if invokerId == AdminUserId || invokerId == lockerData.OwnerId {
+		return true
+	}
+	for _, administratorId := range lockerData.AdministratorIds {
+		if administratorId == invokerId {
+			return true
+		}
+	}
+	return false
+}
+
+// 呼び出し元がロッカーの所有者(または全体の管理者)かどうか
+func (s *SmartContract) isLockerOwnerInvoker(APIstub shim.ChaincodeStubInterface, lockerData LockerData) bool {
+	invokerId := s.getInvokerId(APIstub)
+	if invokerId == "" {
+		return false
+	}
+	return invokerId == AdminUserId || invokerId == lockerData.OwnerId
+}
+
+func (s *SmartContract) makeLockerAdministratorsResult(lockerData LockerData) sc.Response {
+	result := LockerAdministratorsResult{
+		Status:           StatusOk,
+		LockerId:         lockerData.LockerId,
+		OwnerId:          lockerData.OwnerId,
+		AdministratorIds: lockerData.AdministratorIds,
+	}
+	if result.AdministratorIds == nil {
+		result.AdministratorIds = []string{}
+	}
+	resultAsBytes, _ := json.Marshal(result)
+	return shim.Success(resultAsBytes)
+}
+
+// ロッカーの所有者を設定する(全体の管理者のみ)
+func (s *SmartContract) setLockerOwner(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	lockerId := args[0]
+	ownerId := args[1]
+
+	if !s.isAdminInvoker(APIstub) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "管理者のみ実行できます")
+	}
+
+	lockerData := s.getLockerDataFromState(APIstub, lockerId)
+	if !s.isValidLockerData(lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のロッカーが存在しません")
+	}
+
+	lockerData.OwnerId = ownerId
+	s.putLockerData(APIstub, lockerData)
+
+	return s.makeLockerAdministratorsResult(lockerData)
+}
+
+// ロッカーの管理者を追加する(所有者のみ)
+func (s *SmartContract) addLockerAdministrator(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	lockerId := args[0]
+	administratorId := args[1]
+	if administratorId == "" {
+		return shim.Error("Incorrect type of arguments.")
+	}
+
+	lockerData := s.getLockerDataFromState(APIstub, lockerId)
+	if !s.isValidLockerData(lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のロッカーが存在しません")
+	}
+	if !s.isLockerOwnerInvoker(APIstub, lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "対象のロッカーの所有者ではありません")
+	}
+
+	for _, id := range lockerData.AdministratorIds {
+		if id == administratorId {
+			return s.makeErrorResponce(APIstub, StatusConflict, "すでにロッカーの管理者です")
+		}
+	}
+
+	lockerData.AdministratorIds = append(lockerData.AdministratorIds, administratorId)
+	s.putLockerData(APIstub, lockerData)
+
+	return s.makeLockerAdministratorsResult(lockerData)
+}
+
+// ロッカーの管理者を削除する(所有者のみ)
+func (s *SmartContract) removeLockerAdministrator(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	lockerId := args[0]
+	administratorId := args[1]
+
+	lockerData := s.getLockerDataFromState(APIstub, lockerId)
+	if !s.isValidLockerData(lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のロッカーが存在しません")
+	}
+	if !s.isLockerOwnerInvoker(APIstub, lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "対象のロッカーの所有者ではありません")
+	}
+
+	administratorIds := []string{}
+	for _, id := range lockerData.AdministratorIds {
+		if id != administratorId {
+			administratorIds = append(administratorIds, id)
+		}
+	}
+	if len(administratorIds) == len(lockerData.AdministratorIds) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のロッカーの管理者ではありません")
+	}
+
+	lockerData.AdministratorIds = administratorIds
+	s.putLockerData(APIstub, lockerData)
+
+	return s.makeLockerAdministratorsResult(lockerData)
+}
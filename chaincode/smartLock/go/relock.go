@@ -0,0 +1,246 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+type SetMaxUnlockedDurationResult GetLockerDataResult
+
+type SetRelockAgentResult struct {
+	Status  Status `json:"status"`
+	AgentId string `json:"agent_id"` // "relock_scheduler"
+	Enabled bool   `json:"enabled"`  // true
+}
+
+type OverdueLocker struct {
+	LockerData     LockerData `json:"locker_data"`
+	OverdueMinutes int        `json:"overdue_minutes"` // 12 (上限を超えている時間)
+}
+
+type GetOverdueLockersResult struct {
+	Status         Status          `json:"status"`
+	OverdueLockers []OverdueLocker `json:"overdue_lockers"`
+}
+
+type RelockExpiredResult struct {
+	Status     Status       `json:"status"`
+	LockerData []LockerData `json:"locker_data"` // 施錠したロッカー
+}
+
+// 自動施錠できるアイデンティティ用Stateキー作成関数
+func (s *SmartContract) makeRelockAgentKey(agentId string) string {
+	return "relock_agent_" + agentId
+}
+
+// 呼び出し元が自動施錠できるかどうか(管理者または登録された端末・スケジューラ)
+func (s *SmartContract) isRelockAgentInvoker(APIstub shim.ChaincodeStubInterface) bool {
+	invokerId := s.getInvokerId(APIstub)
+	if invokerId == "" {
+		return false
+	}
+	if invokerId == AdminUserId {
+		return true
+	}
+	agentAsBytes, _ := APIstub.GetState(s.makeRelockAgentKey(invokerId))
+	return len(agentAsBytes) != 0
+}
+
+// 開錠時間の上限を超えている時間(分)を返す(超えていなければ0以下)
+func (s *SmartContract) getOverdueMinutes(lockerData LockerData, now time.Time) int {
+	if lockerData.LockerStatus != StatusUnlock || lockerData.MaxUnlockedMinutes <= 0 {
+		return 0
+	}
+	unlockedAt, err := time.Parse(DateTimeFormat, lockerData.LastChangeStatusTime)
+	if err != nil {
+		return 0
+	}
+	deadline := unlockedAt.Add(time.Duration(lockerData.MaxUnlockedMinutes) * time.Minute)
+	if !now.After(deadline) {
+		return 0
+	}
+	return int(now.Sub(deadline)/time.Minute) + 1
+}
+
+// 開錠時間の上限を超えているロッカーの一覧を取得する
+func (s *SmartContract) getOverdueLockerList(APIstub shim.ChaincodeStubInterface, now time.Time) ([]OverdueLocker, error) {
+	overdueLockers := []OverdueLocker{}
+
+	lockerIterator, err := APIstub.GetStateByRange(s.makeLockerDataKey(""), s.makeLockerDataKey(string(utf8.MaxRune)))
+	if err != nil {
+		return nil, err
+	}
+	defer lockerIterator.Close()
+
+	for lockerIterator.HasNext() {
+		queryResponse, err := lockerIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		lockerData := LockerData{}
+		if err := json.Unmarshal(queryResponse.Value, &lockerData); err != nil || !s.isValidLockerData(lockerData) {
+			continue
+		}
+		overdueMinutes := s.getOverdueMinutes(lockerData, now)
+		if overdueMinutes <= 0 {
+			continue
+		}
+		overdueLockers = append(overdueLockers, OverdueLocker{
+			LockerData:     s.normalizeLockerPermissions(lockerData),
+			OverdueMinutes: overdueMinutes,
+		})
+	}
+
+	return overdueLockers, nil
+}
+
+// ロッカーの開錠時間の上限を設定する(ロッカーの管理者のみ)
+// 0を指定すると無制限
+func (s *SmartContract) setMaxUnlockedDuration(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	lockerId := args[0]
+	minutes, err := strconv.Atoi(args[1])
+	if err != nil || minutes < 0 {
+		return shim.Error("Incorrect type of arguments.")
+	}
+
+	lockerData := s.getLockerDataFromState(APIstub, lockerId)
+	if !s.isValidLockerData(lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のロッカーが存在しません")
+	}
+	if !s.canManageLocker(APIstub, lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "対象のロッカーの管理権限がありません")
+	}
+
+	lockerData.MaxUnlockedMinutes = minutes
+	s.putLockerData(APIstub, lockerData)
+
+	result := SetMaxUnlockedDurationResult{Status: StatusOk, LockerData: lockerData}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 自動施錠できる端末・スケジューラのアイデンティティを登録・解除する(管理者のみ)
+func (s *SmartContract) setRelockAgent(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	agentId := args[0]
+	enabled, err := strconv.ParseBool(args[1])
+	if err != nil || agentId == "" {
+		return shim.Error("Incorrect type of arguments.")
+	}
+
+	if !s.isAdminInvoker(APIstub) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "管理者のみ実行できます")
+	}
+
+	if enabled {
+		APIstub.PutState(s.makeRelockAgentKey(agentId), []byte{0x00})
+	} else {
+		APIstub.DelState(s.makeRelockAgentKey(agentId))
+	}
+
+	result := SetRelockAgentResult{Status: StatusOk, AgentId: agentId, Enabled: enabled}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 開錠時間の上限を超えて開いたままのロッカーの一覧を取得する
+func (s *SmartContract) getOverdueLockers(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	overdueLockers, err := s.getOverdueLockerList(APIstub, s.getTxTime(APIstub))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result := GetOverdueLockersResult{Status: StatusOk, OverdueLockers: overdueLockers}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
+
+// 開錠時間の上限を超えたロッカーを施錠する(管理者、登録された端末・スケジューラのみ)
+// 引数でロッカーIDを指定した場合はそのロッカーのみ、省略した場合は全ロッカーが対象
+func (s *SmartContract) relockExpired(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if !s.isRelockAgentInvoker(APIstub) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "自動施錠の権限がありません")
+	}
+
+	now := s.getTxTime(APIstub)
+
+	targets := []LockerData{}
+	if len(args) == 0 {
+		overdueLockers, err := s.getOverdueLockerList(APIstub, now)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for _, overdueLocker := range overdueLockers {
+			targets = append(targets, overdueLocker.LockerData)
+		}
+	} else {
+		for _, lockerId := range args {
+			lockerData := s.getLockerDataFromState(APIstub, lockerId)
+			if s.isValidLockerData(lockerData) && s.getOverdueMinutes(lockerData, now) > 0 {
+				targets = append(targets, lockerData)
+			}
+		}
+	}
+
+	invokerId := s.getInvokerId(APIstub)
+	relocked := []LockerData{}
+	for _, lockerData := range targets {
+		lockerData.LockerStatus = StatusLock
+		lockerData.LastChangeStatusTime = now.Format(DateTimeFormat)
+		lockerData.RelockedBy = invokerId
+		s.putLockerData(APIstub, lockerData)
+
+		accessEvent := s.makeAccessEvent(APIstub, "", lockerData.LockerId, StatusLock, now)
+		accessEvent.Reason = "開錠時間の上限を超えたため自動施錠しました"
+		s.grantAccess(APIstub, accessEvent)
+
+		relocked = append(relocked, lockerData)
+	}
+
+	result := RelockExpiredResult{Status: StatusOk, LockerData: relocked}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
@@ -0,0 +1,224 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 時刻の書式
+const TimeOfDayFormat = "15:04"
+
+// 曜日の表記
+var scheduleDayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// "+09:00"形式の時差
+var fixedZonePattern = regexp.MustCompile(`^([+-])(\d{2}):(\d{2})$`)
+
+// 権限を利用できる曜日・時間帯
+type AccessSchedule struct {
+	Days        []string     `json:"days"`         // ["mon", "tue", "wed", "thu", "fri"]
+	TimeWindows []TimeWindow `json:"time_windows"` // 空の場合は終日
+	TimeZone    string       `json:"time_zone"`    // "+09:00" (UTCからの時差。空の場合はUTC)
+}
+
+// 時間帯(開始を含み終了を含まない。日をまたぐ指定はできない)
+type TimeWindow struct {
+	Start string `json:"start"` // "09:00"
+	End   string `json:"end"`   // "18:00"
+}
+
+type SetPermissionScheduleResult struct {
+	Status     Status           `json:"status"`
+	LockerId   string           `json:"locker_id"`
+	Permission LockerPermission `json:"permission"`
+}
+
+// タイムゾーンを解釈する
+// 地域名("Asia/Tokyo"など)は実行環境のタイムゾーンデータによってendorserごとに結果が変わりうるため、"+09:00"形式の時差のみ受け付ける
+func (s *SmartContract) loadScheduleLocation(timeZone string) (*time.Location, error) {
+	if timeZone == "" {
+		return time.UTC, nil
+	}
+	matches := fixedZonePattern.FindStringSubmatch(timeZone)
+	if matches == nil {
+		return nil, errors.New("invalid time zone: " + timeZone)
+	}
+	hours, _ := strconv.Atoi(matches[2])
+	minutes, _ := strconv.Atoi(matches[3])
+	if hours > 14 || minutes >= 60 {
+		return nil, errors.New("invalid time zone: " + timeZone)
+	}
+	offset := hours*60*60 + minutes*60
+	if matches[1] == "-" {
+		offset = -offset
+	}
+	return time.FixedZone(timeZone, offset), nil
+}
+
+// "HH:MM"を0時からの分に変換する
+func (s *SmartContract) parseTimeOfDay(value string) (int, bool) {
+	t, err := time.Parse(TimeOfDayFormat, value)
+	if err != nil {
+		return 0, false
+	}
+	return t.Hour()*60 + t.Minute(), true
+}
+
+// 引数からスケジュールを作成する
+// 曜日は"mon,tue"、時間帯は"09:00-12:00,13:00-18:00"の形式
+func (s *SmartContract) parseAccessSchedule(daysArg string, windowsArg string, timeZone string) (AccessSchedule, bool) {
+	schedule := AccessSchedule{Days: []string{}, TimeWindows: []TimeWindow{}, TimeZone: timeZone}
+
+	if _, err := s.loadScheduleLocation(timeZone); err != nil {
+		return schedule, false
+	}
+
+	for _, day := range strings.Split(daysArg, ",") {
+		day = strings.ToLower(strings.TrimSpace(day))
+		valid := false
+		for _, name := range scheduleDayNames {
+			if name == day {
+				valid = true
+			}
+		}
+		if !valid {
+			return schedule, false
+		}
+		schedule.Days = append(schedule.Days, day)
+	}
+
+	if windowsArg == "" {
+		return schedule, true
+	}
+	for _, window := range strings.Split(windowsArg, ",") {
+		parts := strings.Split(strings.TrimSpace(window), "-")
+		if len(parts) != 2 {
+			return schedule, false
+		}
+		start, ok := s.parseTimeOfDay(parts[0])
+		if !ok {
+			return schedule, false
+		}
+		end, ok := s.parseTimeOfDay(parts[1])
+		if !ok || end <= start {
+			return schedule, false
+		}
+		schedule.TimeWindows = append(schedule.TimeWindows, TimeWindow{Start: parts[0], End: parts[1]})
+	}
+
+	return schedule, true
+}
+
+// 指定日時がスケジュールの曜日・時間帯内か判定し、範囲外の場合は理由を返す
+func (s *SmartContract) checkAccessSchedule(schedule AccessSchedule, now time.Time) (bool, string) {
+	location, err := s.loadScheduleLocation(schedule.TimeZone)
+	if err != nil {
+		return false, "スケジュールのタイムゾーンが不正です(" + schedule.TimeZone + ")"
+	}
+	local := now.In(location)
+
+	today := scheduleDayNames[local.Weekday()]
+	dayAllowed := false
+	for _, day := range schedule.Days {
+		if day == today {
+			dayAllowed = true
+		}
+	}
+	if !dayAllowed {
+		return false, "利用できない曜日です(" + strings.Join(schedule.Days, ",") + " " + schedule.TimeZone + ")"
+	}
+
+	if len(schedule.TimeWindows) == 0 {
+		return true, ""
+	}
+
+	minute := local.Hour()*60 + local.Minute()
+	windows := []string{}
+	for _, window := range schedule.TimeWindows {
+		start, _ := s.parseTimeOfDay(window.Start)
+		end, _ := s.parseTimeOfDay(window.End)
+		if start <= minute && minute < end {
+			return true, ""
+		}
+		windows = append(windows, window.Start+"-"+window.End)
+	}
+
+	return false, "利用できない時間帯です(" + strings.Join(windows, ",") + " " + schedule.TimeZone + ")"
+}
+
+// ユーザーまたはグループの権限に曜日・時間帯の制限を設定する(ロッカーの所有者・管理者のみ)
+// 引数はロッカーID、種別("user"/"group")、ユーザーIDまたはグループID、曜日、時間帯、タイムゾーン("+09:00"形式)
+// 制限は開錠のみに適用し、施錠は時間外でもできる
+// 曜日を空にすると制限を解除する
+func (s *SmartContract) setPermissionSchedule(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 6 {
+		return shim.Error("Incorrect number of arguments. Expecting 6")
+	}
+
+	lockerId := args[0]
+	kind := args[1]
+	id := args[2]
+	if kind != "user" && kind != "group" {
+		return shim.Error("Incorrect type of arguments.")
+	}
+
+	var schedule *AccessSchedule
+	if args[3] != "" {
+		parsed, ok := s.parseAccessSchedule(args[3], args[4], args[5])
+		if !ok {
+			return s.makeErrorResponce(APIstub, StatusBadRequest, "スケジュールの形式が不正です")
+		}
+		schedule = &parsed
+	}
+
+	lockerData := s.getLockerDataFromState(APIstub, lockerId)
+	if !s.isValidLockerData(lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のロッカーが存在しません")
+	}
+	if !s.canManageLocker(APIstub, lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "対象のロッカーの管理権限がありません")
+	}
+
+	index := s.findLockerPermission(lockerData, id)
+	if kind == "group" {
+		index = s.findGroupLockerPermission(lockerData, id)
+	}
+	if index < 0 {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象の権限が見つかりませんでした")
+	}
+
+	lockerData.Permissions[index].Schedule = schedule
+	s.putLockerData(APIstub, lockerData)
+
+	result := SetPermissionScheduleResult{Status: StatusOk, LockerId: lockerId, Permission: lockerData.Permissions[index]}
+	resultAsBytes, _ := json.Marshal(result)
+
+	return shim.Success(resultAsBytes)
+}
@@ -24,14 +24,21 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	sc "github.com/hyperledger/fabric/protos/peer"
 )
 
 type UserData struct {
 	UserId                   string        `json:"user_id"`                      // "kohun_0001"
-	CardIdmHash              string        `json:"card_idm_hash"`                // "gq8235u8qweguba1se3bose6irfsd"
+	CardIdmHash              string        `json:"card_idm_hash,omitempty"`      // "gq8235u8qweguba1se3bose6irfsd" (照合用のデータ導入前の登録のみ。照合に成功したら置き換える)
 	LastChangeStatusLockerId string        `json:"last_change_status_locker_id"` // "box_0001"
+	CardSalt                 string        `json:"card_salt,omitempty"`          // "8f3a2c1d" (カードIDmのハッシュ化に使うユーザー毎のソルト)
+	CardVerifier             string        `json:"card_verifier,omitempty"`      // "9f86d081..." (提示されたハッシュをさらにソルト付きでハッシュ化したもの)
+	CardVerifierSalt         string        `json:"card_verifier_salt,omitempty"` // "5feceb66..."
+	CardFingerprint          string        `json:"card_fingerprint,omitempty"`   // "3b4c1f0e..." (提示されたハッシュから計算したカードの識別子。導入前の登録は照合に成功したら記録する)
+	FailedAttempts           int           `json:"failed_attempts"`              // 0
+	SuspendedUntil           string        `json:"suspended_until"`              // "2018-09-22 20:47:11 UTC" (照合に続けて失敗した場合の操作停止の期限)
 }
 
 type LockerData struct {
@@ -39,16 +46,39 @@ type LockerData struct {
 	LockerStatus           LockerStatus  `json:"from_user_id"`               //"locked"
 	LastChangeStatusTime   string        `json:"last_change_status_time"`    // "2018-09-22 20:32:11 UTC"
 	LastChangeStatusUserId string        `json:"last_change_status_user_id"` // "kohun_0001"
-	AllowedUnlockUserIds   []string      `json:"allowed_unlock_user_ids"`    // ["kohun_0001"]
+	AllowedUnlockUserIds   []string      `json:"allowed_unlock_user_ids"`    // ["kohun_0001"] (Permissionsから作成する)
+	Permissions            []LockerPermission `json:"permissions"`
+	OwnerId                string        `json:"owner_id"`                   // "facility_manager"
+	AdministratorIds       []string      `json:"administrator_ids"`          // ["floor_manager_3f"]
+	Location               string        `json:"location"`                   // "本社3F 給湯室横"
+	Size                   string        `json:"size"`                       // "M"
+	IsDecommissioned       bool          `json:"is_decommissioned"`          // false
+	DecommissionedAt       string        `json:"decommissioned_at"`          // "2018-09-22 20:32:11 UTC"
+	MaxUnlockedMinutes     int           `json:"max_unlocked_minutes"`       // 30 (0の場合は無制限)
+	RelockedBy             string        `json:"relocked_by"`                // "relock_scheduler" (自動施錠した場合のみ)
+	DeviceId               string        `json:"device_id"`                  // "lock_device_0001" (状態を報告する錠前端末のFabricアイデンティティ)
+}
+
+// ロッカーの開錠権限
+// ユーザーかグループのどちらか一方に付与する
+// 有効期間の開始・終了は空の場合は無期限とする
+type LockerPermission struct {
+	UserId     string          `json:"user_id"`            // "kohun_0001"
+	GroupId    string          `json:"group_id,omitempty"` // "team_dev"
+	ValidFrom  string          `json:"valid_from"`         // "2018-09-22 09:00:00 UTC"
+	ValidUntil string          `json:"valid_until"`        // "2018-09-29 18:00:00 UTC"
+	Schedule   *AccessSchedule `json:"schedule,omitempty"` // 曜日・時間帯の制限(なければ常時)
 }
 
 type Status int
 
 const (
 	StatusOk Status = 200
+	StatusBadRequest Status = 400
 	StatusNotFound Status = 404
 	StatusNotAllowed Status = 405
 	StatusConflict Status = 409
+	StatusTooManyAttempts Status = 429
 )
 
 type LockerStatus string
@@ -61,6 +91,9 @@ const (
 const DateTimeFormat = "2006-01-02 15:04:05 UTC"
 const DefaultLockerId string = "box_0001"
 
+// 全ロッカーを管理できるFabricアイデンティティ(証明書のCN)
+const AdminUserId string = "admin"
+
 type GetUserDataResult struct {
 	Status   Status        `json:"status"`
 	UserData UserData      `json:"user_data"`
@@ -68,9 +101,11 @@ type GetUserDataResult struct {
 type RegisterUserResult GetUserDataResult
 
 type GiveLockerPermissionResult struct {
-	Status Status        `json:"status"`
-	UserId string        `json:"user_id"`
+	Status     Status           `json:"status"`
+	UserId     string           `json:"user_id"`
+	Permission LockerPermission `json:"permission"`
 }
+type RevokeLockerPermissionResult GiveLockerPermissionResult
 
 type GetLockerDataResult struct {
 	Status     Status        `json:"status"`
@@ -108,6 +143,111 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 	if function == "giveLockerPermission" {
 		return s.giveLockerPermission(APIstub, args)
 	}
+	if function == "revokeLockerPermission" {
+		return s.revokeLockerPermission(APIstub, args)
+	}
+	if function == "setLockerOwner" {
+		return s.setLockerOwner(APIstub, args)
+	}
+	if function == "addLockerAdministrator" {
+		return s.addLockerAdministrator(APIstub, args)
+	}
+	if function == "removeLockerAdministrator" {
+		return s.removeLockerAdministrator(APIstub, args)
+	}
+	if function == "registerLocker" {
+		return s.registerLocker(APIstub, args)
+	}
+	if function == "decommissionLocker" {
+		return s.decommissionLocker(APIstub, args)
+	}
+	if function == "listLockers" {
+		return s.listLockers(APIstub, args)
+	}
+	if function == "resetCardSuspension" {
+		return s.resetCardSuspension(APIstub, args)
+	}
+	if function == "getLockerAccessLog" {
+		return s.getLockerAccessLog(APIstub, args)
+	}
+	if function == "getUserAccessLog" {
+		return s.getUserAccessLog(APIstub, args)
+	}
+	if function == "setMaxUnlockedDuration" {
+		return s.setMaxUnlockedDuration(APIstub, args)
+	}
+	if function == "setRelockAgent" {
+		return s.setRelockAgent(APIstub, args)
+	}
+	if function == "getOverdueLockers" {
+		return s.getOverdueLockers(APIstub, args)
+	}
+	if function == "relockExpired" {
+		return s.relockExpired(APIstub, args)
+	}
+	if function == "createUserGroup" {
+		return s.createUserGroup(APIstub, args)
+	}
+	if function == "addUserGroupMember" {
+		return s.addUserGroupMember(APIstub, args)
+	}
+	if function == "removeUserGroupMember" {
+		return s.removeUserGroupMember(APIstub, args)
+	}
+	if function == "getUserGroup" {
+		return s.getUserGroup(APIstub, args)
+	}
+	if function == "giveGroupLockerPermission" {
+		return s.giveGroupLockerPermission(APIstub, args)
+	}
+	if function == "revokeGroupLockerPermission" {
+		return s.revokeGroupLockerPermission(APIstub, args)
+	}
+	if function == "getEffectivePermissions" {
+		return s.getEffectivePermissions(APIstub, args)
+	}
+	if function == "issueGuestCode" {
+		return s.issueGuestCode(APIstub, args)
+	}
+	if function == "revokeGuestCodes" {
+		return s.revokeGuestCodes(APIstub, args)
+	}
+	if function == "getGuestCodes" {
+		return s.getGuestCodes(APIstub, args)
+	}
+	if function == "changeLockerStatusWithCode" {
+		return s.changeLockerStatusWithCode(APIstub, args)
+	}
+	if function == "setMasterOverrideRole" {
+		return s.setMasterOverrideRole(APIstub, args)
+	}
+	if function == "overrideUnlock" {
+		return s.overrideUnlock(APIstub, args)
+	}
+	if function == "getOverrideLog" {
+		return s.getOverrideLog(APIstub, args)
+	}
+	if function == "setLockerDevice" {
+		return s.setLockerDevice(APIstub, args)
+	}
+	if function == "reportDeviceState" {
+		return s.reportDeviceState(APIstub, args)
+	}
+	if function == "getDeviceState" {
+		return s.getDeviceState(APIstub, args)
+	}
+	if function == "getStateMismatches" {
+		return s.getStateMismatches(APIstub, args)
+	}
+	if function == "replaceCard" {
+		return s.replaceCard(APIstub, args)
+	}
+	if function == "getCardReplacementHistory" {
+		return s.getCardReplacementHistory(APIstub, args)
+	}
+	if function == "setPermissionSchedule" {
+		return s.setPermissionSchedule(APIstub, args)
+	}
 	if function == "changeLockerStatus" {
 		return s.changeLockerStatus(APIstub, args)
 	}
@@ -126,17 +266,43 @@ func (s *SmartContract) makeLockerDataKey(lockerId string) string {
 }
 
 // 空のLockerData構造体作成
-func (s *SmartContract) makeEmptyLockerData(lockerId string) LockerData {
+func (s *SmartContract) makeEmptyLockerData(lockerId string, now time.Time) LockerData {
 	result := LockerData{
 		LockerId: lockerId,
 		LockerStatus: StatusLock,
-		LastChangeStatusTime:  time.Now().Format(DateTimeFormat),
+		LastChangeStatusTime:  now.Format(DateTimeFormat),
 		LastChangeStatusUserId:  "",
 		AllowedUnlockUserIds: []string{},
+		Permissions: []LockerPermission{},
+		AdministratorIds: []string{},
 	}
 	return result
 }
 
+// 呼び出し元のFabricアイデンティティ(証明書のCN)を取得する
+func (s *SmartContract) getInvokerId(APIstub shim.ChaincodeStubInterface) string {
+	cert, err := cid.GetX509Certificate(APIstub)
+	if err != nil || cert == nil {
+		return ""
+	}
+	return cert.Subject.CommonName
+}
+
+// 呼び出し元が管理者かどうか
+func (s *SmartContract) isAdminInvoker(APIstub shim.ChaincodeStubInterface) bool {
+	return s.getInvokerId(APIstub) == AdminUserId
+}
+
+// トランザクションのタイムスタンプを取得する
+// endorserごとに結果が変わらないよう、現在時刻ではなくこちらを使う
+func (s *SmartContract) getTxTime(APIstub shim.ChaincodeStubInterface) time.Time {
+	txTimestamp, err := APIstub.GetTxTimestamp()
+	if err != nil {
+		return time.Now().UTC()
+	}
+	return time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()
+}
+
 // エラーレスポンスを生成する
 func (s *SmartContract) makeErrorResponce(APIstub shim.ChaincodeStubInterface, code Status, message string) sc.Response {
 	result := ErrorResult{
@@ -174,7 +340,97 @@ func (s *SmartContract) getLockerDataFromState(APIstub shim.ChaincodeStubInterfa
 		json.Unmarshal(lockerDataAsBytes, lockerData)
 	}
 
-	return *lockerData
+	return s.normalizeLockerPermissions(*lockerData)
+}
+
+// 権限の一覧(Permissions)がない古いデータは、AllowedUnlockUserIdsを無期限の権限として扱う
+func (s *SmartContract) normalizeLockerPermissions(lockerData LockerData) LockerData {
+	if lockerData.Permissions == nil {
+		lockerData.Permissions = []LockerPermission{}
+	}
+	for _, userId := range lockerData.AllowedUnlockUserIds {
+		if s.findLockerPermission(lockerData, userId) < 0 {
+			lockerData.Permissions = append(lockerData.Permissions, LockerPermission{UserId: userId})
+		}
+	}
+	return lockerData
+}
+
+// 指定ユーザーの権限の位置を返す(なければ-1)
+func (s *SmartContract) findLockerPermission(lockerData LockerData, userId string) int {
+	if userId == "" {
+		return -1
+	}
+	for i, permission := range lockerData.Permissions {
+		if permission.UserId == userId {
+			return i
+		}
+	}
+	return -1
+}
+
+// 指定グループの権限の位置を返す(なければ-1)
+func (s *SmartContract) findGroupLockerPermission(lockerData LockerData, groupId string) int {
+	if groupId == "" {
+		return -1
+	}
+	for i, permission := range lockerData.Permissions {
+		if permission.GroupId == groupId {
+			return i
+		}
+	}
+	return -1
+}
+
+// 権限の有効期間の引数を解釈する(空文字は無期限)
+func (s *SmartContract) parsePermissionTerm(permission LockerPermission, fromArg string, untilArg string) (LockerPermission, Status, string) {
+	var validFrom, validUntil time.Time
+	var err error
+	if fromArg != "" {
+		validFrom, err = time.Parse(DateTimeFormat, fromArg)
+		if err != nil {
+			return permission, StatusBadRequest, "有効期間の開始の形式が不正です"
+		}
+		permission.ValidFrom = validFrom.UTC().Format(DateTimeFormat)
+	}
+	if untilArg != "" {
+		validUntil, err = time.Parse(DateTimeFormat, untilArg)
+		if err != nil {
+			return permission, StatusBadRequest, "有効期間の終了の形式が不正です"
+		}
+		permission.ValidUntil = validUntil.UTC().Format(DateTimeFormat)
+	}
+	if fromArg != "" && untilArg != "" && !validUntil.After(validFrom) {
+		return permission, StatusBadRequest, "有効期間の終了が開始より前です"
+	}
+	return permission, StatusOk, ""
+}
+
+// 権限が指定日時に開錠に使えるかどうか
+func (s *SmartContract) isActiveLockerPermission(permission LockerPermission, now time.Time) bool {
+	ok, _ := s.checkLockerPermission(permission, StatusUnlock, now)
+	return ok
+}
+
+// 権限が指定日時に有効期間内かつ利用可能な曜日・時間帯かどうか判定し、無効な場合は理由を返す
+// 曜日・時間帯の制限は開錠のみに適用する(時間外に開いたままのロッカーを施錠できるように)
+func (s *SmartContract) checkLockerPermission(permission LockerPermission, toStatus LockerStatus, now time.Time) (bool, string) {
+	if permission.ValidFrom != "" {
+		validFrom, err := time.Parse(DateTimeFormat, permission.ValidFrom)
+		if err != nil || now.Before(validFrom) {
+			return false, "権限の有効期間前です(" + permission.ValidFrom + "から)"
+		}
+	}
+	if permission.ValidUntil != "" {
+		validUntil, err := time.Parse(DateTimeFormat, permission.ValidUntil)
+		if err != nil || !now.Before(validUntil) {
+			return false, "権限の有効期間が終了しています(" + permission.ValidUntil + "まで)"
+		}
+	}
+	if permission.Schedule != nil && toStatus != StatusLock {
+		return s.checkAccessSchedule(*permission.Schedule, now)
+	}
+	return true, ""
 }
 
 // ロッカーデータが有効であるか判別する
@@ -183,6 +439,11 @@ func (s *SmartContract) isValidLockerData(lockerData LockerData) bool {
 		return false
 	}
 
+	// 廃止済みのロッカーは操作できない
+	if lockerData.IsDecommissioned {
+		return false
+	}
+
 	// 論理削除や有効期限など追加した場合はここでチェックする
 
 	return true
@@ -190,7 +451,7 @@ func (s *SmartContract) isValidLockerData(lockerData LockerData) bool {
 
 // ユーザーデータが有効であるか判別する
 func (s *SmartContract) isValidUserData(userData UserData) bool {
-	if userData.CardIdmHash == "" {
+	if userData.CardVerifier == "" && userData.CardIdmHash == "" {
 		return false
 	}
 
@@ -210,16 +471,35 @@ func (s *SmartContract) canChangeLockerStatus(lockerData LockerData, toStatus Lo
 	return true
 }
 
-// ロッカーを開錠できるかどうか判別する
-func (s *SmartContract) isAuthorizedUserForLocker(userData UserData, lockerData LockerData) bool {
+// ロッカーを開閉できるかどうか判別し、できない場合は理由を返す
+// ユーザーへの権限に加えて、所属するグループへの権限も判定する
+// 権限の有効期間・曜日・時間帯はトランザクションの日時で判定する(曜日・時間帯は開錠のみ)
+func (s *SmartContract) isAuthorizedUserForLocker(APIstub shim.ChaincodeStubInterface, userData UserData, lockerData LockerData, toStatus LockerStatus, now time.Time) (bool, string) {
+
+	reason := "対象のロッカーの開錠権限がありません"
+	if userData.UserId == "" {
+		return false, reason
+	}
 
-	for _, authorizedUserId := range lockerData.AllowedUnlockUserIds {
-		if authorizedUserId == userData.UserId {
-			return true
+	denied := false
+	for _, permission := range lockerData.Permissions {
+		if permission.UserId != userData.UserId {
+			if permission.GroupId == "" || !s.isGroupMember(s.getUserGroupFromState(APIstub, permission.GroupId), userData.UserId) {
+				continue
+			}
+		}
+		ok, message := s.checkLockerPermission(permission, toStatus, now)
+		if ok {
+			return true, ""
+		}
+		// 該当する権限がすべて無効な場合は最初の理由を返す
+		if !denied {
+			denied = true
+			reason = message
 		}
 	}
 
-	return false
+	return false, reason
 }
 
 // ユーザーデータput
@@ -230,7 +510,15 @@ func (s *SmartContract) putUserData(APIstub shim.ChaincodeStubInterface, userDat
 }
 
 // ロッカーデータput
+// AllowedUnlockUserIdsは権限の一覧から作り直す
 func (s *SmartContract) putLockerData(APIstub shim.ChaincodeStubInterface, lockerData LockerData) {
+	lockerData.AllowedUnlockUserIds = []string{}
+	for _, permission := range lockerData.Permissions {
+		if permission.UserId != "" {
+			lockerData.AllowedUnlockUserIds = append(lockerData.AllowedUnlockUserIds, permission.UserId)
+		}
+	}
+
 	key := s.makeLockerDataKey(lockerData.LockerId)
 	lockerDataAsBytes, _ := json.Marshal(lockerData)
 	APIstub.PutState(key, lockerDataAsBytes)
@@ -239,15 +527,15 @@ func (s *SmartContract) putLockerData(APIstub shim.ChaincodeStubInterface, locke
 // デフォルトのロッカーデータの初期化
 func (s *SmartContract) initDefaultLocker(APIstub shim.ChaincodeStubInterface) sc.Response {
 	defaultLocker := s.getLockerDataFromState(APIstub, DefaultLockerId)
-	// すでに有効なロッカーデータがあるならそれを返却
-	if s.isValidLockerData(defaultLocker) {
+	// すでにロッカーデータがあるならそれを返却(廃止済みでも作り直さない)
+	if defaultLocker.LockerId != "" {
 		result := GetLockerDataResult{Status: StatusOk, LockerData: defaultLocker}
 		resultAsBytes, _ := json.Marshal(result)
 		return shim.Success(resultAsBytes)
 	}
 
 	// 有効なロッカーがなければ空のデータを作成してput
-	emptyLockerData := s.makeEmptyLockerData(DefaultLockerId)
+	emptyLockerData := s.makeEmptyLockerData(DefaultLockerId, s.getTxTime(APIstub))
 	s.putLockerData(APIstub, emptyLockerData)
 
 	result := GetLockerDataResult{Status: StatusOk, LockerData: emptyLockerData}
@@ -257,51 +545,127 @@ func (s *SmartContract) initDefaultLocker(APIstub shim.ChaincodeStubInterface) s
 }
 
 // ユーザーデータの登録
+// 引数はユーザーID、ハッシュ化に使ったソルト
+// カードIDmのハッシュは台帳に残さないようtransientデータの"card_idm_hash"で渡す
 func (s *SmartContract) registerUser(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
 	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 3")
+		return shim.Error("Incorrect number of arguments. Expecting 2")
 	}
 
 	userId := args[0]
-	cardIdmHash := args[1]
+	cardSalt := args[1]
+	cardIdmHash := s.getCardHashFromTransient(APIstub, CardTransientKey)
+	if cardIdmHash == "" {
+		return shim.Error("Incorrect type of arguments.")
+	}
+	cardFingerprint := s.makeCardFingerprint(cardIdmHash)
 
 	userData := s.getUserDataFromState(APIstub, userId)
 	// すでに有効なユーザーデータがあるなら登録不可
 	if s.isValidUserData(userData) {
 		return s.makeErrorResponce(APIstub, StatusConflict, "対象のユーザーIDのデータが存在しています")
 	}
+	// 紛失などで無効にしたカード、別のユーザーが登録しているカードは登録不可
+	if status, message := s.checkCardAvailable(APIstub, userId, cardFingerprint); status != StatusOk {
+		return s.makeErrorResponce(APIstub, status, message)
+	}
 
 	// ユーザーデータがなければ空のデータを作成してput
+	// 提示されたハッシュそのものは保存せず、照合用のデータのみ保存する
 	userData.UserId = userId
-	userData.CardIdmHash = cardIdmHash
+	userData.CardIdmHash = ""
+	userData.CardSalt = cardSalt
+	userData.CardFingerprint = cardFingerprint
+	userData.CardVerifierSalt, userData.CardVerifier = s.makeCardVerifier(APIstub, cardIdmHash)
 	s.putUserData(APIstub, userData)
+	APIstub.PutState(s.makeCardFingerprintKey(cardFingerprint), []byte(userId))
 
-	result := RegisterUserResult{Status: StatusOk, UserData: userData}
+	result := RegisterUserResult{Status: StatusOk, UserData: s.sanitizeUserData(userData)}
 	resultAsBytes, _ := json.Marshal(result)
 
 	return shim.Success(resultAsBytes)
 }
 
 // ロッカーに対して操作可能なユーザーを追加する
+// 3つ目、4つ目の引数で有効期間の開始・終了を指定できる(空文字は無期限)
+// すでに権限があるユーザーの場合は有効期間を更新する
 func (s *SmartContract) giveLockerPermission(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
+	if len(args) != 2 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or 4")
+	}
+
+	userId := args[0]
+	lockerId := args[1]
+
+	permission := LockerPermission{UserId: userId}
+	if len(args) == 4 {
+		var status Status
+		var message string
+		permission, status, message = s.parsePermissionTerm(permission, args[2], args[3])
+		if status != StatusOk {
+			return s.makeErrorResponce(APIstub, status, message)
+		}
+	}
+
+	lockerData := s.getLockerDataFromState(APIstub, lockerId)
+	if !s.isValidLockerData(lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のロッカーが存在しません")
+	}
+	if !s.isValidUserData(s.getUserDataFromState(APIstub, userId)) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のユーザーが存在しません")
+	}
+
+	// ロッカーの所有者・管理者のみ権限を付与できる
+	if !s.canManageLocker(APIstub, lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "対象のロッカーの管理権限がありません")
+	}
+
+	// 曜日・時間帯の制限は引き継ぐ
+	if index := s.findLockerPermission(lockerData, userId); index >= 0 {
+		permission.Schedule = lockerData.Permissions[index].Schedule
+		lockerData.Permissions[index] = permission
+	} else {
+		lockerData.Permissions = append(lockerData.Permissions, permission)
+	}
+	s.putLockerData(APIstub, lockerData)
+
+	result := GiveLockerPermissionResult{Status: StatusOk, UserId: userId, Permission: permission}
+	resultAsBytes, _ := json.Marshal(result)
+	return shim.Success(resultAsBytes)
+}
+
+// ロッカーに対して操作可能なユーザーを削除する
+func (s *SmartContract) revokeLockerPermission(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
 	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+		return shim.Error("Incorrect number of arguments. Expecting 2")
 	}
 
 	userId := args[0]
 	lockerId := args[1]
 
 	lockerData := s.getLockerDataFromState(APIstub, lockerId)
+	if !s.isValidLockerData(lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のロッカーが存在しません")
+	}
 
-	//追加の制限かけるならここで色々チェック
+	// ロッカーの所有者・管理者のみ権限を削除できる
+	if !s.canManageLocker(APIstub, lockerData) {
+		return s.makeErrorResponce(APIstub, StatusNotAllowed, "対象のロッカーの管理権限がありません")
+	}
 
+	index := s.findLockerPermission(lockerData, userId)
+	if index < 0 {
+		return s.makeErrorResponce(APIstub, StatusNotFound, "対象のユーザーに権限がありません")
+	}
 
-	lockerData.AllowedUnlockUserIds = append(lockerData.AllowedUnlockUserIds, userId)
+	permission := lockerData.Permissions[index]
+	lockerData.Permissions = append(lockerData.Permissions[:index], lockerData.Permissions[index+1:]...)
 	s.putLockerData(APIstub, lockerData)
 
-	result := GiveLockerPermissionResult{Status: StatusOk, UserId: userId}
+	result := RevokeLockerPermissionResult{Status: StatusOk, UserId: userId, Permission: permission}
 	resultAsBytes, _ := json.Marshal(result)
 	return shim.Success(resultAsBytes)
 }
@@ -312,13 +676,10 @@ func (s *SmartContract) getUserData(APIstub shim.ChaincodeStubInterface, args []
 		return shim.Error("Incorrect number of arguments. Expecting 1")
 	}
 
-	key := s.makeUserDataKey(args[0])
-	userDataAsBytes, _ := APIstub.GetState(key)
-	userData := UserData{}
-	json.Unmarshal(userDataAsBytes, &userData)
+	userData := s.getUserDataFromState(APIstub, args[0])
 
-	result := GetUserDataResult{Status: StatusOk, UserData: userData}
-	if userData.CardIdmHash == "" {
+	result := GetUserDataResult{Status: StatusOk, UserData: s.sanitizeUserData(userData)}
+	if !s.isValidUserData(userData) {
 		result.Status = StatusNotFound
 	}
 
@@ -332,10 +693,7 @@ func (s *SmartContract) getLockerData(APIstub shim.ChaincodeStubInterface, args
 		return shim.Error("Incorrect number of arguments. Expecting 2")
 	}
 
-	key := s.makeLockerDataKey(args[0])
-	lockerDataAsBytes, _ := APIstub.GetState(key)
-	lockerData := LockerData{}
-	json.Unmarshal(lockerDataAsBytes, &lockerData)
+	lockerData := s.getLockerDataFromState(APIstub, args[0])
 
 	result := GetLockerDataResult{Status: StatusOk, LockerData: lockerData}
 	if lockerData.LockerId == "" {
@@ -346,6 +704,8 @@ func (s *SmartContract) getLockerData(APIstub shim.ChaincodeStubInterface, args
 	return shim.Success(resultAsBytes)
 }
 
+// ロッカーを開閉する
+// 提示されたカードのIDmをユーザーのソルトでハッシュ化したものはtransientデータの"card_idm_hash"で渡す
 func (s *SmartContract) changeLockerStatus(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
 	if len(args) != 3 {
@@ -355,27 +715,47 @@ func (s *SmartContract) changeLockerStatus(APIstub shim.ChaincodeStubInterface,
 	userId := args[0]
 	lockerId := args[1]
 	toStatus := LockerStatus(args[2])
+	cardIdmHash := s.getCardHashFromTransient(APIstub, CardTransientKey)
 
 	userData := s.getUserDataFromState(APIstub, userId)
 	lockerData := s.getLockerDataFromState(APIstub, lockerId)
+	now := s.getTxTime(APIstub)
+
+	// 拒否した場合もアクセスログに記録する
+	accessEvent := s.makeAccessEvent(APIstub, userId, lockerId, toStatus, now)
+
+	if !s.isValidLockerData(lockerData) {
+		return s.denyAccess(APIstub, accessEvent, StatusNotFound, "対象のロッカーが存在しません")
+	}
+	if !s.isValidUserData(userData) {
+		return s.denyAccess(APIstub, accessEvent, StatusNotFound, "対象のユーザーが存在しません")
+	}
+
+	//提示されたカードが登録されたものかどうか
+	userData, status, message := s.verifyCard(APIstub, userData, cardIdmHash, now)
+	if status != StatusOk {
+		return s.denyAccess(APIstub, accessEvent, status, message)
+	}
 
 	//対象のロッカーの開錠権限があるかどうか
-	if !s.isAuthorizedUserForLocker(userData, lockerData) {
-		return s.makeErrorResponce(APIstub, StatusNotAllowed, "対象のロッカーの開錠権限がありません")
+	if ok, reason := s.isAuthorizedUserForLocker(APIstub, userData, lockerData, toStatus, now); !ok {
+		return s.denyAccess(APIstub, accessEvent, StatusNotAllowed, reason)
 	}
 
 	//ロッカーの開閉ができるかどうか
 	if !s.canChangeLockerStatus(lockerData, toStatus) {
-		return s.makeErrorResponce(APIstub, StatusConflict, "対象のロッカーの開閉ができませんでした")
+		return s.denyAccess(APIstub, accessEvent, StatusConflict, "対象のロッカーの開閉ができませんでした")
 	}
 
 	lockerData.LockerStatus = toStatus
 	lockerData.LastChangeStatusUserId = userData.UserId
-	lockerData.LastChangeStatusTime = time.Now().Format(DateTimeFormat)
+	lockerData.LastChangeStatusTime = now.Format(DateTimeFormat)
+	lockerData.RelockedBy = ""
 	userData.LastChangeStatusLockerId = lockerData.LockerId
 
 	s.putLockerData(APIstub, lockerData)
 	s.putUserData(APIstub, userData)
+	s.grantAccess(APIstub, accessEvent)
 
 	// レスポンス作成
 	result := ChangeLockerStatusResult{